@@ -0,0 +1,197 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/st3fan/moz-storageserver/storageserver"
+	"net"
+	"os"
+	"strings"
+)
+
+const ENV_PREFIX = "STORAGESERVER_"
+
+type ServerConfig struct {
+	APIPrefix            string
+	ListenAddress        string
+	ListenPort           int
+	MetricsListenAddress string // Host and port for the metrics, disabled if empty
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		APIPrefix:     DEFAULT_API_PREFIX,
+		ListenAddress: DEFAULT_API_LISTEN_ADDRESS,
+		ListenPort:    DEFAULT_API_LISTEN_PORT,
+	}
+}
+
+func (config *ServerConfig) RegisterFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.APIPrefix, "api-prefix", config.APIPrefix, "path prefix of the storage API")
+	fs.StringVar(&config.ListenAddress, "listen-address", config.ListenAddress, "address to listen on")
+	fs.IntVar(&config.ListenPort, "listen-port", config.ListenPort, "port to listen on")
+	fs.StringVar(&config.MetricsListenAddress, "metrics-listen-address", config.MetricsListenAddress, "host:port to serve the backend and shared secret metrics on, keep it private")
+}
+
+func (config *ServerConfig) Validate() error {
+	if !strings.HasPrefix(config.APIPrefix, "/") || strings.HasSuffix(config.APIPrefix, "/") {
+		return fmt.Errorf("The API prefix must start and not end with a slash: %s", config.APIPrefix)
+	}
+	if config.ListenPort <= 0 || config.ListenPort > 65535 {
+		return fmt.Errorf("Invalid listen port: %d", config.ListenPort)
+	}
+	if config.MetricsListenAddress != "" {
+		if _, _, err := net.SplitHostPort(config.MetricsListenAddress); err != nil {
+			return fmt.Errorf("Invalid metrics listen address: %s", config.MetricsListenAddress)
+		}
+	}
+	return nil
+}
+
+// Settings are read from three layers, each overriding the previous
+// one: a JSON config file, STORAGESERVER_ environment variables and
+// command line flags. All layers use the flag names, so -max-post-bytes
+// is max-post-bytes in the file and STORAGESERVER_MAX_POST_BYTES in the
+// environment. The file is given with -config or STORAGESERVER_CONFIG.
+
+func loadConfig(args []string) (ServerConfig, storageserver.Config, error) {
+	// Parse the flags once to find the config file and to remember
+	// which flags were given, so that they can be applied last.
+	serverConfig, config, fs := newConfigFlagSet()
+	var configPath string
+	fs.StringVar(&configPath, "config", os.Getenv(ENV_PREFIX+"CONFIG"), "path of a JSON config file")
+	if err := fs.Parse(args); err != nil {
+		return ServerConfig{}, storageserver.Config{}, err
+	}
+	if fs.NArg() != 0 {
+		return ServerConfig{}, storageserver.Config{}, fmt.Errorf("Unexpected arguments: %v", fs.Args())
+	}
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	serverConfig, config, fs = newConfigFlagSet()
+
+	if configPath != "" {
+		if err := loadConfigFile(fs, configPath); err != nil {
+			return ServerConfig{}, storageserver.Config{}, err
+		}
+	}
+
+	if err := loadConfigEnv(fs); err != nil {
+		return ServerConfig{}, storageserver.Config{}, err
+	}
+
+	for name, value := range given {
+		if name == "config" {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return ServerConfig{}, storageserver.Config{}, err
+		}
+	}
+
+	if err := serverConfig.Validate(); err != nil {
+		return ServerConfig{}, storageserver.Config{}, err
+	}
+	if err := config.Validate(); err != nil {
+		return ServerConfig{}, storageserver.Config{}, err
+	}
+
+	return *serverConfig, *config, nil
+}
+
+func newConfigFlagSet() (*ServerConfig, *storageserver.Config, *flag.FlagSet) {
+	serverConfig := DefaultServerConfig()
+	config := storageserver.DefaultConfig()
+	fs := flag.NewFlagSet("storageserver", flag.ContinueOnError)
+	serverConfig.RegisterFlags(fs)
+	config.RegisterFlags(fs)
+	return &serverConfig, &config, fs
+}
+
+// The config file is a JSON object of setting names to values, like
+// {"backend": "postgres", "quota": 104857600, "reaper-interval": "30m"}.
+// Underscores are accepted in place of dashes. List settings can be given
+// as an array of strings, like {"shared-secrets": ["new", "old"]}, or as
+// a comma separated string like on the command line.
+
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var settings map[string]interface{}
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("Cannot parse config file %s: %s", path, err)
+	}
+
+	for name, value := range settings {
+		name = strings.Replace(name, "_", "-", -1)
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("Unknown setting in config file %s: %s", path, name)
+		}
+		var setting string
+		switch value := value.(type) {
+		case string, json.Number, bool:
+			setting = fmt.Sprint(value)
+		case []interface{}:
+			list, err := configFileList(value)
+			if err != nil {
+				return fmt.Errorf("Invalid value for %s in config file %s: %s", name, path, err)
+			}
+			setting = list
+		default:
+			return fmt.Errorf("Invalid value for %s in config file %s", name, path)
+		}
+		if err := fs.Set(name, setting); err != nil {
+			return fmt.Errorf("Invalid value for %s in config file %s: %s", name, path, err)
+		}
+	}
+
+	return nil
+}
+
+// Lists are passed to the flags as comma separated strings, so the
+// elements cannot contain commas themselves.
+
+func configFileList(values []interface{}) (string, error) {
+	elements := make([]string, len(values))
+	for i, value := range values {
+		element, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("list elements must be strings")
+		}
+		if strings.Contains(element, ",") {
+			return "", fmt.Errorf("list elements cannot contain commas")
+		}
+		elements[i] = element
+	}
+	return strings.Join(elements, ","), nil
+}
+
+func loadConfigEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+		key := ENV_PREFIX + strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))
+		if value, ok := os.LookupEnv(key); ok {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("Invalid value for %s: %s", key, setErr)
+			}
+		}
+	})
+	return err
+}
@@ -0,0 +1,9 @@
+module github.com/st3fan/moz-storageserver
+
+go 1.19
+
+require (
+	github.com/boltdb/bolt v1.3.1
+	github.com/gorilla/mux v1.7.0
+	github.com/lib/pq v1.10.9
+)
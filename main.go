@@ -5,11 +5,16 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/st3fan/moz-storageserver/storageserver"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 const (
@@ -23,21 +28,66 @@ func VersionHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	serverConfig, config, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.DevMode {
+		log.Printf("Running in dev mode, do not use this in production")
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/version", VersionHandler)
 
-	config := storageserver.DefaultConfig()
-
-	_, err := storageserver.SetupRouter(router.PathPrefix(DEFAULT_API_PREFIX).Subrouter(), config)
+	appContext, err := storageserver.SetupRouter(router.PathPrefix(serverConfig.APIPrefix).Subrouter(), config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	router.HandleFunc("/status", appContext.StatusHandler)
+
+	addr := fmt.Sprintf("%s:%d", serverConfig.ListenAddress, serverConfig.ListenPort)
+	server := &http.Server{Addr: addr, Handler: router}
+
+	// The metrics are not authenticated, so they get their own listener
+	// that should not be reachable from the outside
+	var metricsServer *http.Server
+	if serverConfig.MetricsListenAddress != "" {
+		metricsRouter := mux.NewRouter()
+		metricsRouter.HandleFunc("/metrics", appContext.MetricsHandler)
+		metricsServer = &http.Server{Addr: serverConfig.MetricsListenAddress, Handler: metricsRouter}
+		go func() {
+			log.Printf("Serving metrics on http://%s/metrics", serverConfig.MetricsListenAddress)
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// Let running requests finish and close the databases on shutdown
+	done := make(chan bool)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Printf("Shutting down storage server")
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Shutdown: %s", err)
+		}
+		if metricsServer != nil {
+			if err := metricsServer.Shutdown(context.Background()); err != nil {
+				log.Printf("Shutdown: %s", err)
+			}
+		}
+		appContext.Close()
+		close(done)
+	}()
 
-	addr := fmt.Sprintf("%s:%d", DEFAULT_API_LISTEN_ADDRESS, DEFAULT_API_LISTEN_PORT)
 	log.Printf("Starting storage server on http://%s", addr)
-	http.Handle("/", router)
-	err = http.ListenAndServe(addr, nil)
-	if err != nil {
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-done
 }
@@ -5,8 +5,10 @@
 package storageserver
 
 import (
-	"database/sql"
-	_ "github.com/lib/pq"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
 	"time"
 )
 
@@ -22,45 +24,17 @@ func timestampNow() float64 {
 	return float64(time.Now().UnixNano()/10000000) / 100
 }
 
-type DatabaseSession struct {
-	url string
-	db  *sql.DB
-}
+// Requests are timestamped when they come in, so a write that started
+// earlier can commit after a later one. Its modified time must still
+// move the collection forward, otherwise clients that have synced up to
+// the later write never see it. Returns modified, or the first
+// timestamp after lastModified if modified is not later than that.
 
-func NewDatabaseSession(url string) (*DatabaseSession, error) {
-	db, err := sql.Open("postgres", url)
-	if err != nil {
-		return nil, err
-	}
-	err = db.Ping()
-	if err != nil {
-		return nil, err
+func nextModified(lastModified, modified float64) float64 {
+	if modified > lastModified {
+		return modified
 	}
-	return &DatabaseSession{url: url, db: db}, nil
-}
-
-func (session *DatabaseSession) Close() {
-	session.db.Close()
-}
-
-func (ds *DatabaseSession) GetCollectionTimestamps(uid uint64) (map[string]float64, error) {
-	rows, err := ds.db.Query("select Collectionname, max(Modified) from Objects where UserId = $1 group by CollectionName", uid)
-	if err != nil {
-		return nil, err
-	}
-	result := make(map[string]float64)
-	for rows.Next() {
-		var collectionName string
-		var lastModified uint64
-		if err := rows.Scan(&collectionName, &lastModified); err != nil {
-			return nil, err
-		}
-		result[collectionName] = timestampFromInteger(lastModified)
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
-	return result, nil
+	return (math.Round(lastModified*100) + 1) / 100
 }
 
 type Object struct {
@@ -71,130 +45,109 @@ type Object struct {
 	TTL       int     `json:"ttl"`
 }
 
-func (o *Object) Validate() error {
-	return nil
-}
+// Validation
 
-func (ds *DatabaseSession) GetObject(userId uint64, collectionName string, objectId string) (*Object, error) {
-	var modified uint64
-	var object Object
-	err := ds.db.QueryRow("select Id,Modified,Payload from Objects where UserId = $1 and collectionName = $2 and Id = $3", userId, collectionName, objectId).
-		Scan(&object.Id, &modified, &object.Payload)
-
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		} else {
-			return nil, err
-		}
-	}
-	object.Modified = timestampFromInteger(modified)
-	return &object, nil
-}
+const (
+	MAX_SORTINDEX = 999999999
+	MAX_TTL       = 31536000
+)
 
-func (ds *DatabaseSession) PutObject(userId uint64, collectionName string, objectId string, object Object) (float64, error) {
-	var exists bool
-	if err := ds.db.QueryRow("SELECT 1 FROM Objects WHERE UserId=$1 and CollectionName=$2 and Id=$3", userId, collectionName, objectId).Scan(&exists); err != nil && err != sql.ErrNoRows {
-		return 0, err
-	}
+var validObjectId = regexp.MustCompile(`^[ -~]{1,64}$`)
 
-	existingObject, err := ds.GetObject(userId, collectionName, objectId)
-	if err != nil {
-		return 0, err
-	}
+var InvalidObjectErr = errors.New("invalid object")
+var InvalidIdErr = errors.New("invalid id")
+var InvalidSortIndexErr = errors.New("invalid sortindex")
+var InvalidTTLErr = errors.New("invalid ttl")
+var InvalidPayloadErr = errors.New("invalid payload")
+var PayloadTooLargeErr = errors.New("payload too large")
 
-	if exists {
-		if object.Modified == 0.0 {
-			object.Modified = existingObject.Modified
-		}
-		if object.TTL == 0 {
-			object.TTL = existingObject.TTL
-		}
-		if object.Payload == "" {
-			object.Payload = existingObject.Payload
-		}
-		if object.SortIndex == 0 {
-			object.SortIndex = existingObject.SortIndex
-		}
-		if _, err := ds.db.Exec("update Objects set SortIndex=$1,Modified=$2, Payload=$3, TTL=$4 where UserId=$5 and CollectionName=$6 and Id=$7", object.SortIndex, integerFromTimestamp(object.Modified), object.Payload, object.TTL, userId, collectionName, objectId); err != nil {
-			return 0, err
-		}
-	} else {
-		if object.Modified == 0.0 {
-			object.Modified = timestampNow()
-		}
-		if object.TTL == 0 {
-			object.TTL = 2100000000
-		}
-		if _, err := ds.db.Exec("insert into Objects (UserId, CollectionName, Id, SortIndex, Modified, Payload, TTL) values ($1, $2, $3, $4, $5, $6, $7)", userId, collectionName, objectId, object.SortIndex, integerFromTimestamp(object.Modified), object.Payload, object.TTL); err != nil {
-			return 0, err
+// Decode a single object. Fields of the wrong type are reported as the
+// validation error for that field. The returned object always carries
+// the id, if there is one, so that failures can be reported against it.
+
+func UnmarshalObject(data []byte) (Object, error) {
+	var object Object
+	if err := json.Unmarshal(data, &object); err != nil {
+		if typeError, ok := err.(*json.UnmarshalTypeError); ok {
+			switch typeError.Field {
+			case "id":
+				return object, InvalidIdErr
+			case "sortindex":
+				return object, InvalidSortIndexErr
+			case "ttl":
+				return object, InvalidTTLErr
+			case "payload":
+				return object, InvalidPayloadErr
+			}
 		}
+		return object, InvalidObjectErr
 	}
-
-	return object.Modified, nil
+	return object, nil
 }
 
-func (ds *DatabaseSession) GetObjects(userId uint64, collectionName string, limit int, newer float64) ([]Object, error) {
-	if limit == 0 {
-		limit = 5000
+// Check the object against the Sync 1.5 rules: ids are 1 to 64 printable
+// ASCII characters, sortindexes have at most nine digits, TTLs are
+// between zero and a year and payloads are no larger than maxPayloadBytes.
+
+func (o *Object) Validate(maxPayloadBytes int) error {
+	if !validObjectId.MatchString(o.Id) {
+		return InvalidIdErr
 	}
-	rows, err := ds.db.Query("select Id,Modified,Payload from Objects where UserId = $1 and CollectionName = $2 and Modified > $3 order by Modified limit $4", userId, collectionName, integerFromTimestamp(newer), limit)
-	if err != nil {
-		return nil, err
+	if o.SortIndex < -MAX_SORTINDEX || o.SortIndex > MAX_SORTINDEX {
+		return InvalidSortIndexErr
 	}
-	var result []Object
-	for rows.Next() {
-		var modified uint64
-		var object Object
-		if err := rows.Scan(&object.Id, &modified, &object.Payload); err != nil {
-			return nil, err
-		}
-		object.Modified = timestampFromInteger(modified)
-		result = append(result, object)
+	if o.TTL < 0 || o.TTL > MAX_TTL {
+		return InvalidTTLErr
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	if len(o.Payload) > maxPayloadBytes {
+		return PayloadTooLargeErr
 	}
-	return result, nil
+	return nil
 }
 
-// TODO: Get rid of this because I don't think it is actually used on any device?
-func (ds *DatabaseSession) GetObjectIds(userId uint64, limit int, newer float64) ([]string, error) {
-	panic("GetObjectIds is not implemented. Should it?")
-	return nil, nil
-}
+// An object has expired when its TTL, counted in seconds from the
+// time it was last modified, has passed.
 
-func (ds *DatabaseSession) DeleteCollectionObjects(userId uint64, collectionName string) error {
-	_, err := ds.db.Exec("delete from Objects where UserId = $1 and CollectionName = $2", userId, collectionName)
-	return err
+func (o *Object) Expired(now float64) bool {
+	return o.Modified+float64(o.TTL) <= now
 }
 
-func (ds *DatabaseSession) DeleteUserObjects(userId uint64) error {
-	_, err := ds.db.Exec("delete from Objects where UserId = $1", userId)
-	return err
+// Objects that do not expire have a TTL that is far in the future.
+
+const DEFAULT_TTL = 2100000000
+
+// Returns the seconds until a live object expires, rounded up. Objects
+// that do not expire keep the default TTL.
+
+func remainingTTL(object *Object, now float64) int {
+	if object.TTL == DEFAULT_TTL {
+		return DEFAULT_TTL
+	}
+	// Round to centiseconds first so that float errors do not add a second
+	remaining := math.Round((object.Modified+float64(object.TTL)-now)*100) / 100
+	return int(math.Ceil(remaining))
 }
 
-func (ds *DatabaseSession) SetObjects(userId uint64, collectionName string, objects []Object) (float64, error) {
-	var lastModified float64
-	for _, object := range objects {
-		if object.Modified > lastModified {
-			lastModified = object.Modified
-		}
+// Fill in the fields that were left out of an update from the existing
+// object, which is nil if there is none. Objects that have expired are
+// treated as if they do not exist. The TTL counts from the modified
+// time, which the update moves to now, so an update without a TTL gets
+// what is left of the existing one to keep the object's expiry time.
 
-		var exists bool
-		if err := ds.db.QueryRow("SELECT 1 FROM Objects WHERE UserId=$1 and CollectionName=$2 and Id=$3", userId, collectionName, object.Id).Scan(&exists); err != nil && err != sql.ErrNoRows {
-			return 0, err
+func mergeObject(object *Object, existingObject *Object, now float64) {
+	if existingObject == nil || existingObject.Expired(now) {
+		if object.TTL == 0 {
+			object.TTL = DEFAULT_TTL
 		}
-
-		if exists {
-			if _, err := ds.db.Exec("update Objects set SortIndex=$1,Modified=$2, Payload=$3, TTL=$4 where UserId=$5 and CollectionName=$6 and Id=$7", object.SortIndex, integerFromTimestamp(object.Modified), object.Payload, object.TTL, userId, collectionName, object.Id); err != nil {
-				return 0, err
-			}
-		} else {
-			if _, err := ds.db.Exec("insert into Objects (UserId, CollectionName, Id, SortIndex, Modified, Payload, TTL) values ($1, $2, $3, $4, $5, $6, $7)", userId, collectionName, object.Id, object.SortIndex, integerFromTimestamp(object.Modified), object.Payload, object.TTL); err != nil {
-				return 0, err
-			}
+	} else {
+		if object.TTL == 0 {
+			object.TTL = remainingTTL(existingObject, now)
+		}
+		if object.Payload == "" {
+			object.Payload = existingObject.Payload
+		}
+		if object.SortIndex == 0 {
+			object.SortIndex = existingObject.SortIndex
 		}
 	}
-	return lastModified, nil
 }
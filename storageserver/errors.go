@@ -0,0 +1,154 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Weave error codes. Sync clients expect one of these as the JSON body
+// of an error response.
+
+const (
+	WEAVE_UNKNOWN_ERROR       = 0
+	WEAVE_JSON_PARSE_FAILURE  = 6
+	WEAVE_INVALID_WBO         = 8
+	WEAVE_OVER_QUOTA          = 14
+	WEAVE_SIZE_LIMIT_EXCEEDED = 17
+)
+
+// An error that can be sent to the client as an HTTP status and a Weave
+// error code.
+
+type StorageError struct {
+	Status int
+	Code   int
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("%s (%d)", http.StatusText(e.Status), e.Code)
+}
+
+var BadRequestErr = &StorageError{Status: http.StatusBadRequest, Code: WEAVE_UNKNOWN_ERROR}
+var InvalidJSONErr = &StorageError{Status: http.StatusBadRequest, Code: WEAVE_JSON_PARSE_FAILURE}
+var InvalidWBOErr = &StorageError{Status: http.StatusBadRequest, Code: WEAVE_INVALID_WBO}
+var OverQuotaResponseErr = &StorageError{Status: http.StatusForbidden, Code: WEAVE_OVER_QUOTA}
+var ForbiddenErr = &StorageError{Status: http.StatusForbidden, Code: WEAVE_UNKNOWN_ERROR}
+var NotFoundErr = &StorageError{Status: http.StatusNotFound, Code: WEAVE_UNKNOWN_ERROR}
+var MethodNotAllowedErr = &StorageError{Status: http.StatusMethodNotAllowed, Code: WEAVE_UNKNOWN_ERROR}
+var NotAcceptableErr = &StorageError{Status: http.StatusNotAcceptable, Code: WEAVE_UNKNOWN_ERROR}
+var PreconditionFailedErr = &StorageError{Status: http.StatusPreconditionFailed, Code: WEAVE_UNKNOWN_ERROR}
+var RequestTooLargeErr = &StorageError{Status: http.StatusRequestEntityTooLarge, Code: WEAVE_SIZE_LIMIT_EXCEEDED}
+var UnsupportedMediaTypeErr = &StorageError{Status: http.StatusUnsupportedMediaType, Code: WEAVE_UNKNOWN_ERROR}
+var InternalServerErr = &StorageError{Status: http.StatusInternalServerError, Code: WEAVE_UNKNOWN_ERROR}
+var NotImplementedErr = &StorageError{Status: http.StatusNotImplemented, Code: WEAVE_UNKNOWN_ERROR}
+var ServiceUnavailableErr = &StorageError{Status: http.StatusServiceUnavailable, Code: WEAVE_UNKNOWN_ERROR}
+
+// Map an error returned by the storage layer to the response it should
+// produce. Anything we do not know about is an internal error.
+
+func storageErrorFor(err error) *StorageError {
+	var storageError *StorageError
+	if errors.As(err, &storageError) {
+		return storageError
+	}
+
+	var preconditionFailedError *PreconditionFailedError
+	if errors.As(err, &preconditionFailedError) {
+		return PreconditionFailedErr
+	}
+
+	if isRequestTooLarge(err) {
+		return RequestTooLargeErr
+	}
+
+	switch err {
+	case InvalidObjectErr, InvalidIdErr, InvalidSortIndexErr, InvalidTTLErr, InvalidPayloadErr:
+		return InvalidWBOErr
+	case PayloadTooLargeErr, BatchTooLargeErr:
+		return RequestTooLargeErr
+	case OverQuotaErr:
+		return OverQuotaResponseErr
+	case CollectionNotFoundErr, ObjectNotFoundErr:
+		return NotFoundErr
+	case BatchNotFoundErr, InvalidOffsetErr:
+		return BadRequestErr
+	case DatabasePoolClosedErr:
+		return ServiceUnavailableErr
+	case NotSupportedErr:
+		return NotImplementedErr
+	}
+
+	return InternalServerErr
+}
+
+// Write the error response for err. The body is the Weave error code;
+// internal errors are logged but their details never reach the client.
+
+func writeError(w http.ResponseWriter, err error) {
+	storageError := storageErrorFor(err)
+	if storageError == InternalServerErr {
+		log.Printf("Internal server error: %v", err)
+	}
+
+	var preconditionFailedError *PreconditionFailedError
+	if errors.As(err, &preconditionFailedError) {
+		w.Header().Set("X-Last-Modified", fmt.Sprintf("%.2f", preconditionFailedError.LastModified))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(storageError.Status)
+	fmt.Fprintf(w, "%d", storageError.Code)
+}
+
+// The response for credentials that were valid but cannot be used,
+// like an expired token. Sync clients look for the invalid-credentials
+// status to decide that they need a new token.
+
+type invalidCredentialsError struct {
+	Location    string `json:"location"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type invalidCredentialsResponse struct {
+	Status string                    `json:"status"`
+	Errors []invalidCredentialsError `json:"errors"`
+}
+
+func writeInvalidCredentials(w http.ResponseWriter, description string) {
+	response := invalidCredentialsResponse{
+		Status: "invalid-credentials",
+		Errors: []invalidCredentialsError{{Location: "header", Name: "Authorization", Description: description}},
+	}
+	encodedResponse, err := json.Marshal(response)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("WWW-Authenticate", "Hawk")
+	w.WriteHeader(http.StatusUnauthorized)
+	w.Write(encodedResponse)
+}
+
+func isRequestTooLarge(err error) bool {
+	var maxBytesError *http.MaxBytesError
+	return errors.As(err, &maxBytesError)
+}
+
+// Failing to decode a request body means either that the body was too
+// large or that it was not valid JSON.
+
+func decodeError(err error) error {
+	if isRequestTooLarge(err) {
+		return RequestTooLargeErr
+	}
+	return InvalidJSONErr
+}
@@ -0,0 +1,331 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"math"
+)
+
+// Every collection is stored in three buckets: the objects bucket,
+// keyed by object id, and two secondary index buckets keyed by
+// modified time and by sortindex. Index keys are the big endian sort
+// value followed by the object id so that a cursor walks the
+// collection in sort order. Index values are empty.
+//
+// The index bucket names contain a colon, which is not allowed in
+// collection names, so they cannot clash with a collection. Collection
+// names are checked by the routes, see COLLECTION_NAME_PATTERN.
+
+func modifiedIndexBucketName(collectionName string) []byte {
+	return []byte("Modified:" + collectionName)
+}
+
+func sortIndexBucketName(collectionName string) []byte {
+	return []byte("SortIndex:" + collectionName)
+}
+
+func modifiedIndexKey(object *Object) []byte {
+	key := make([]byte, 8+len(object.Id))
+	binary.BigEndian.PutUint64(key, integerFromTimestamp(object.Modified))
+	copy(key[8:], object.Id)
+	return key
+}
+
+func sortIndexKey(object *Object) []byte {
+	key := make([]byte, 8+len(object.Id))
+	// Flip the sign bit so that negative sortindexes sort before positive ones
+	binary.BigEndian.PutUint64(key, uint64(int64(object.SortIndex))^(1<<63))
+	copy(key[8:], object.Id)
+	return key
+}
+
+func objectIdFromIndexKey(key []byte) []byte {
+	return key[8:]
+}
+
+type collectionBuckets struct {
+	objects   *bolt.Bucket
+	modified  *bolt.Bucket
+	sortIndex *bolt.Bucket
+}
+
+// Returns the buckets of an existing collection or nil if the
+// collection does not exist. The index buckets are only nil for
+// collections that were written before indexes existed, until
+// OpenObjectDatabase builds them.
+
+func getCollectionBuckets(tx *bolt.Tx, collectionName string) *collectionBuckets {
+	objectsBucket := tx.Bucket([]byte(collectionName))
+	if objectsBucket == nil {
+		return nil
+	}
+	return &collectionBuckets{
+		objects:   objectsBucket,
+		modified:  tx.Bucket(modifiedIndexBucketName(collectionName)),
+		sortIndex: tx.Bucket(sortIndexBucketName(collectionName)),
+	}
+}
+
+// Returns the buckets of a collection, creating them if needed. If the
+// index buckets are missing then they are rebuilt from the objects.
+
+func createCollectionBuckets(tx *bolt.Tx, collectionName string) (*collectionBuckets, error) {
+	objectsBucket, err := tx.CreateBucketIfNotExists([]byte(collectionName))
+	if err != nil {
+		return nil, err
+	}
+
+	reindex := tx.Bucket(modifiedIndexBucketName(collectionName)) == nil || tx.Bucket(sortIndexBucketName(collectionName)) == nil
+
+	modifiedBucket, err := tx.CreateBucketIfNotExists(modifiedIndexBucketName(collectionName))
+	if err != nil {
+		return nil, err
+	}
+	sortIndexBucket, err := tx.CreateBucketIfNotExists(sortIndexBucketName(collectionName))
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := &collectionBuckets{
+		objects:   objectsBucket,
+		modified:  modifiedBucket,
+		sortIndex: sortIndexBucket,
+	}
+
+	// Collections written before indexes existed also do not have their
+	// usage and count recorded yet, so recompute those too
+	if reindex {
+		usage, count := 0, 0
+		err := objectsBucket.ForEach(func(k, v []byte) error {
+			var object Object
+			if err := json.Unmarshal(v, &object); err != nil {
+				return err
+			}
+			usage += len(object.Payload)
+			count++
+			return buckets.index(&object)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := setCollectionUsage(tx, collectionName, usage, count); err != nil {
+			return nil, err
+		}
+	}
+
+	return buckets, nil
+}
+
+func deleteCollectionBuckets(tx *bolt.Tx, collectionName string) error {
+	names := [][]byte{
+		[]byte(collectionName),
+		modifiedIndexBucketName(collectionName),
+		sortIndexBucketName(collectionName),
+	}
+	for _, name := range names {
+		if tx.Bucket(name) != nil {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (buckets *collectionBuckets) index(object *Object) error {
+	if err := buckets.modified.Put(modifiedIndexKey(object), []byte{}); err != nil {
+		return err
+	}
+	return buckets.sortIndex.Put(sortIndexKey(object), []byte{})
+}
+
+func (buckets *collectionBuckets) unindex(object *Object) error {
+	if err := buckets.modified.Delete(modifiedIndexKey(object)); err != nil {
+		return err
+	}
+	return buckets.sortIndex.Delete(sortIndexKey(object))
+}
+
+// Store the object and keep the indexes in sync. Returns the change in
+// payload bytes stored and in the number of objects, which is one for a
+// new object. The buckets must have been obtained with
+// createCollectionBuckets.
+
+func (buckets *collectionBuckets) put(object *Object) (int, int, error) {
+	delta, added := len(object.Payload), 1
+	if encodedExistingObject := buckets.objects.Get([]byte(object.Id)); encodedExistingObject != nil {
+		var existingObject Object
+		if err := json.Unmarshal(encodedExistingObject, &existingObject); err != nil {
+			return 0, 0, err
+		}
+		if err := buckets.unindex(&existingObject); err != nil {
+			return 0, 0, err
+		}
+		delta -= len(existingObject.Payload)
+		added = 0
+	}
+	if err := putEncodedObject(buckets.objects, object.Id, object); err != nil {
+		return 0, 0, err
+	}
+	return delta, added, buckets.index(object)
+}
+
+// Delete the object and its index entries. Returns the change in
+// payload bytes stored, or ObjectNotFoundErr if the object does not
+// exist. The buckets must have been obtained with createCollectionBuckets.
+
+func (buckets *collectionBuckets) delete(objectId string) (int, error) {
+	encodedObject := buckets.objects.Get([]byte(objectId))
+	if encodedObject == nil {
+		return 0, ObjectNotFoundErr
+	}
+	var object Object
+	if err := json.Unmarshal(encodedObject, &object); err != nil {
+		return 0, err
+	}
+	if err := buckets.unindex(&object); err != nil {
+		return 0, err
+	}
+	return -len(object.Payload), buckets.objects.Delete([]byte(objectId))
+}
+
+// Call fn for every live object that matches the options, in the
+// order requested by options.Sort. Without a sort the objects are
+// returned in id order, or in the order of options.Ids if given. The
+// position passed to fn can be used in an Offset to resume the
+// iteration after that object. The iteration stops when fn returns an
+// error.
+
+func (buckets *collectionBuckets) forEach(options *GetObjectsOptions, now float64, fn func(object *Object, position []byte) error) error {
+	var ids map[string]bool
+	if len(options.Ids) != 0 {
+		ids = make(map[string]bool)
+		for _, objectId := range options.Ids {
+			ids[objectId] = true
+		}
+	}
+
+	visit := func(objectId []byte, position []byte) error {
+		if ids != nil && !ids[string(objectId)] {
+			return nil
+		}
+		encodedObject := buckets.objects.Get(objectId)
+		if encodedObject == nil {
+			return nil
+		}
+		var object Object
+		if err := json.Unmarshal(encodedObject, &object); err != nil {
+			return err
+		}
+		if object.Modified <= options.Newer || object.Expired(now) {
+			return nil
+		}
+		if options.Older != 0 && object.Modified >= options.Older {
+			return nil
+		}
+		// Objects modified after the first page was read are not part of the walk
+		if options.Offset != nil && object.Modified > options.Offset.Snapshot {
+			return nil
+		}
+		return fn(&object, position)
+	}
+
+	var after []byte
+	if options.Offset != nil {
+		after = options.Offset.Position
+	}
+
+	var indexBucket *bolt.Bucket
+	switch options.Sort {
+	case SORT_NEWEST, SORT_OLDEST:
+		indexBucket = buckets.modified
+	case SORT_INDEX:
+		indexBucket = buckets.sortIndex
+	}
+	if options.Sort != "" && indexBucket == nil {
+		return MissingIndexErr
+	}
+
+	// Index positions start with the sort value, and like in Postgres
+	// modified times never have the top bit set
+	if indexBucket != nil && after != nil {
+		if len(after) < 8 || (indexBucket == buckets.modified && binary.BigEndian.Uint64(after) > math.MaxInt64) {
+			return InvalidOffsetErr
+		}
+	}
+
+	switch {
+	case indexBucket != nil && options.Sort == SORT_OLDEST:
+		cursor := indexBucket.Cursor()
+		for k, _ := seekAfter(cursor, after); k != nil; k, _ = cursor.Next() {
+			if err := visit(objectIdFromIndexKey(k), k); err != nil {
+				return err
+			}
+		}
+	case indexBucket != nil:
+		cursor := indexBucket.Cursor()
+		for k, _ := seekBefore(cursor, after); k != nil; k, _ = cursor.Prev() {
+			if err := visit(objectIdFromIndexKey(k), k); err != nil {
+				return err
+			}
+		}
+	case ids != nil:
+		start := 0
+		if after != nil {
+			// The position comes from the client, so it can be anything
+			if len(after) != 8 || binary.BigEndian.Uint64(after) >= uint64(len(options.Ids)) {
+				return InvalidOffsetErr
+			}
+			start = int(binary.BigEndian.Uint64(after)) + 1
+		}
+		for i := start; i < len(options.Ids); i++ {
+			position := make([]byte, 8)
+			binary.BigEndian.PutUint64(position, uint64(i))
+			if err := visit([]byte(options.Ids[i]), position); err != nil {
+				return err
+			}
+		}
+	default:
+		cursor := buckets.objects.Cursor()
+		for k, _ := seekAfter(cursor, after); k != nil; k, _ = cursor.Next() {
+			if err := visit(k, k); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Position the cursor on the first key after the given key, or on the
+// first key if no key is given.
+
+func seekAfter(cursor *bolt.Cursor, after []byte) ([]byte, []byte) {
+	if after == nil {
+		return cursor.First()
+	}
+	k, v := cursor.Seek(after)
+	if k != nil && bytes.Equal(k, after) {
+		return cursor.Next()
+	}
+	return k, v
+}
+
+// Position the cursor on the last key before the given key, or on the
+// last key if no key is given.
+
+func seekBefore(cursor *bolt.Cursor, before []byte) ([]byte, []byte) {
+	if before == nil {
+		return cursor.Last()
+	}
+	if k, _ := cursor.Seek(before); k == nil {
+		return cursor.Last()
+	}
+	return cursor.Prev()
+}
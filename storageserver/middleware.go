@@ -0,0 +1,120 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"context"
+	"fmt"
+	"github.com/gorilla/mux"
+	"github.com/st3fan/gohawk/hawk"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	timestampContextKey contextKey = iota
+	credentialsContextKey
+	storageContextKey
+)
+
+// Captures a single server timestamp for the request. Handlers use it
+// as the modification time for writes and it is returned to the client
+// in X-Weave-Timestamp on every response, including errors.
+
+func timestampMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp := timestampNow()
+		w.Header().Set("X-Weave-Timestamp", fmt.Sprintf("%.2f", timestamp))
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), timestampContextKey, timestamp)))
+	})
+}
+
+func requestTimestamp(r *http.Request) float64 {
+	if timestamp, ok := r.Context().Value(timestampContextKey).(float64); ok {
+		return timestamp
+	}
+	return timestampNow()
+}
+
+// The Hawk authenticator. It writes the error response itself when a
+// request cannot be authenticated. Tests replace it so that they can
+// send tokens without signing the requests.
+
+type authenticator interface {
+	Authenticate(w http.ResponseWriter, r *http.Request) (hawk.Credentials, bool)
+}
+
+// Authenticates the request with Hawk and checks that the token was
+// issued for this node and for the user in the URL. Expired tokens and
+// tokens for other nodes are refused with a 401 so that the client
+// fetches a new token. A valid token only gives access to its own
+// storage, any other {userId} is refused with a 403.
+
+func (c *AppContext) authenticationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hawkCredentials, ok := c.hawkAuthenticator.Authenticate(w, r)
+		if !ok {
+			return
+		}
+		credentials := hawkCredentials.(*Credentials)
+		if requestTimestamp(r) >= float64(credentials.expires) {
+			writeInvalidCredentials(w, "Token has expired")
+			return
+		}
+		if c.publicNode != "" && normalizeNode(credentials.node) != c.publicNode {
+			writeInvalidCredentials(w, "Token was issued for another node")
+			return
+		}
+		if !checkUserId(r, credentials.uid) {
+			writeError(w, ForbiddenErr)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), credentialsContextKey, credentials)))
+	})
+}
+
+func checkUserId(r *http.Request, uid uint64) bool {
+	userId, err := strconv.ParseUint(mux.Vars(r)["userId"], 10, 64)
+	return err == nil && userId == uid
+}
+
+// Tokens carry the node as a URL. Compare them without case in the
+// scheme and host and without a trailing slash.
+
+func normalizeNode(node string) string {
+	u, err := url.Parse(node)
+	if err != nil {
+		return node
+	}
+	return strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + strings.TrimSuffix(u.Path, "/")
+}
+
+// Acquires the storage of the authenticated user for the duration of
+// the request. Must run after the authentication middleware.
+
+func (c *AppContext) storageMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uid := requestCredentials(r).uid
+		storage, err := c.backend.Acquire(uid)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		defer c.backend.Release(uid)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), storageContextKey, storage)))
+	})
+}
+
+func requestCredentials(r *http.Request) *Credentials {
+	return r.Context().Value(credentialsContextKey).(*Credentials)
+}
+
+func requestStorage(r *http.Request) Storage {
+	return r.Context().Value(storageContextKey).(Storage)
+}
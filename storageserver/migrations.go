@@ -0,0 +1,114 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The Postgres schema is defined by the numbered SQL files in the
+// migrations directory, which are compiled into the binary. Each file
+// is applied once, in order, in its own transaction, and recorded in
+// the SchemaMigrations table. Never edit a migration that has shipped,
+// add a new one instead.
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Any constant will do, it only has to be the same for all servers
+const MIGRATIONS_LOCK_ID = 0x73746f72
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// Returns the embedded migrations ordered by version. File names start
+// with the version number, as in 0001_initial.sql.
+
+func loadMigrations() ([]migration, error) {
+	names, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+	var migrations []migration
+	for _, entry := range names {
+		name := entry.Name()
+		version, err := strconv.Atoi(strings.SplitN(name, "_", 2)[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid migration name: %s", name)
+		}
+		data, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(data)})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("Duplicate migration version: %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// Apply all migrations that have not been applied yet. Servers that
+// start at the same time take turns through an advisory lock, so every
+// migration runs exactly once.
+
+func (ds *DatabaseSession) Migrate() error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	err = ds.transaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("select pg_advisory_xact_lock($1)", MIGRATIONS_LOCK_ID); err != nil {
+			return err
+		}
+		_, err := tx.Exec("create table if not exists SchemaMigrations (Version integer primary key, Name text not null, AppliedAt timestamp with time zone not null default now())")
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		err := ds.transaction(func(tx *sql.Tx) error {
+			if _, err := tx.Exec("select pg_advisory_xact_lock($1)", MIGRATIONS_LOCK_ID); err != nil {
+				return err
+			}
+			var applied bool
+			if err := tx.QueryRow("select exists (select 1 from SchemaMigrations where Version = $1)", m.version).Scan(&applied); err != nil {
+				return err
+			}
+			if applied {
+				return nil
+			}
+			log.Printf("Applying migration %s", m.name)
+			if _, err := tx.Exec(m.sql); err != nil {
+				return fmt.Errorf("Migration %s failed: %s", m.name, err)
+			}
+			_, err := tx.Exec("insert into SchemaMigrations (Version, Name) values ($1, $2)", m.version, m.name)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -2,15 +2,17 @@
 -- License, v. 2.0. If a copy of the MPL was not distributed with this
 -- file, You can obtain one at http://mozilla.org/MPL/2.0/
 
--- TODO: This can probably become a view on Objects
-create table UserCollections (
+-- The schema as it was created by the original setup.sql. Databases
+-- that were set up with that script already have these tables.
+
+create table if not exists UserCollections (
   UserId             integer not null,
   CollectionName     varchar(32) not null,
   primary key (UserId, CollectionName),
   LastModified       bigint not null
 );
 
-create table Objects (
+create table if not exists Objects (
   UserId             integer not null,
   CollectionName     varchar(32) not null,
   Id                 varchar(64) not null,
@@ -0,0 +1,31 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+-- Timestamps are stored in hundredths of a second
+
+alter table UserCollections alter column UserId type bigint;
+alter table Objects alter column UserId type bigint;
+
+update Objects set SortIndex = 0 where SortIndex is null;
+alter table Objects alter column SortIndex set default 0, alter column SortIndex set not null;
+
+update Objects set PayloadSize = octet_length(Payload);
+
+-- UserCollections was not maintained before
+insert into UserCollections (UserId, CollectionName, LastModified)
+  select UserId, CollectionName, max(Modified) from Objects group by UserId, CollectionName
+  on conflict (UserId, CollectionName) do update set LastModified = excluded.LastModified;
+
+create index ObjectsModified on Objects (UserId, CollectionName, Modified);
+create index ObjectsSortIndex on Objects (UserId, CollectionName, SortIndex);
+
+create table Batches (
+  Id                 bigserial primary key,
+  UserId             bigint not null,
+  CollectionName     varchar(32) not null,
+  Expires            bigint not null,
+  Objects            text not null default '[]'
+);
+
+create index BatchesUser on Batches (UserId, CollectionName);
@@ -0,0 +1,12 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+-- The time of the last delete of a collection or of the whole storage,
+-- in hundredths of a second. The rows in UserCollections are gone
+-- after a delete, so they cannot tell when it happened.
+
+create table UserStorage (
+  UserId             bigint primary key,
+  LastModified       bigint not null
+);
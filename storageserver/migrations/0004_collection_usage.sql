@@ -0,0 +1,12 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+-- The payload bytes stored in each collection, kept up to date by every
+-- write so that usage does not have to be summed over all objects.
+
+alter table UserCollections add column Usage bigint not null default 0;
+
+update UserCollections c set Usage = o.Usage
+  from (select UserId, CollectionName, sum(PayloadSize) as Usage from Objects group by UserId, CollectionName) o
+  where c.UserId = o.UserId and c.CollectionName = o.CollectionName;
@@ -0,0 +1,12 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+-- The number of objects stored in each collection, kept up to date like
+-- Usage. Expired objects are counted until the reaper deletes them.
+
+alter table UserCollections add column Count bigint not null default 0;
+
+update UserCollections c set Count = o.Count
+  from (select UserId, CollectionName, count(*) as Count from Objects group by UserId, CollectionName) o
+  where c.UserId = o.UserId and c.CollectionName = o.CollectionName;
@@ -0,0 +1,166 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONTENT_TYPE_JSON     = "application/json"
+	CONTENT_TYPE_NEWLINES = "application/newlines"
+)
+
+// Content types we can produce, in order of preference when the client
+// accepts several of them equally.
+
+var supportedContentTypes = []string{CONTENT_TYPE_JSON, CONTENT_TYPE_NEWLINES}
+
+// Pick the content type for the response based on the Accept header.
+// Media ranges like */* and application/* and q-values are honoured. A
+// missing Accept header means application/json. Returns an empty string
+// if none of the supported types are acceptable.
+
+func negotiateContentType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return CONTENT_TYPE_JSON
+	}
+
+	bestContentType, bestQuality := "", 0.0
+	for _, contentType := range supportedContentTypes {
+		if quality := acceptQuality(accept, contentType); quality > bestQuality {
+			bestContentType, bestQuality = contentType, quality
+		}
+	}
+	return bestContentType
+}
+
+// Returns the quality the Accept header assigns to the content type. The
+// most specific matching media range wins.
+
+func acceptQuality(accept, contentType string) float64 {
+	quality, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		var s int
+		switch {
+		case mediaType == contentType:
+			s = 2
+		case mediaType == "*/*":
+			s = 0
+		case strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(mediaType, "*")):
+			s = 1
+		default:
+			continue
+		}
+
+		if s > specificity {
+			q := 1.0
+			if value, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(value, 64); err != nil {
+					q = 0
+				}
+			}
+			quality, specificity = q, s
+		}
+	}
+	return quality
+}
+
+// Returns the media type of the request body without parameters.
+
+func requestContentType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// Writes a list of records either as a JSON array or as one JSON
+// record per line, without buffering the whole list.
+
+type recordWriter struct {
+	w           io.Writer
+	contentType string
+	count       int
+}
+
+func newRecordWriter(w io.Writer, contentType string) *recordWriter {
+	return &recordWriter{w: w, contentType: contentType}
+}
+
+func (rw *recordWriter) Begin() error {
+	if rw.contentType == CONTENT_TYPE_JSON {
+		_, err := io.WriteString(rw.w, "[")
+		return err
+	}
+	return nil
+}
+
+func (rw *recordWriter) Write(record interface{}) error {
+	encodedRecord, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if rw.contentType == CONTENT_TYPE_JSON {
+		if rw.count != 0 {
+			if _, err := io.WriteString(rw.w, ","); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := rw.w.Write(encodedRecord); err != nil {
+		return err
+	}
+	if rw.contentType == CONTENT_TYPE_NEWLINES {
+		if _, err := io.WriteString(rw.w, "\n"); err != nil {
+			return err
+		}
+	}
+	rw.count++
+	return nil
+}
+
+func (rw *recordWriter) End() error {
+	if rw.contentType == CONTENT_TYPE_JSON {
+		_, err := io.WriteString(rw.w, "]")
+		return err
+	}
+	return nil
+}
+
+// Reads the records in a POST body, which is either a JSON array or
+// one JSON record per line. The records are decoded individually so
+// that a bad record does not spoil the whole request.
+
+func decodeRecords(r io.Reader, contentType string) ([]json.RawMessage, error) {
+	decoder := json.NewDecoder(r)
+	var records []json.RawMessage
+	if contentType == CONTENT_TYPE_NEWLINES {
+		for {
+			var record json.RawMessage
+			if err := decoder.Decode(&record); err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+	return records, decoder.Decode(&records)
+}
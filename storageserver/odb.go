@@ -5,10 +5,16 @@
 package storageserver
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/boltdb/bolt"
+	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Errors
@@ -16,6 +22,31 @@ import (
 var CollectionNotFoundErr = errors.New("Collection not found")
 var ObjectNotFoundErr = errors.New("Object not found")
 var IterationCancelledErr = errors.New("Iteration cancelled")
+var BatchNotFoundErr = errors.New("Batch not found")
+var BatchTooLargeErr = errors.New("Batch too large")
+var InvalidOffsetErr = errors.New("Invalid offset")
+var OverQuotaErr = errors.New("Over quota")
+var MissingIndexErr = errors.New("Missing index")
+
+// Returned by write operations when the collection or storage has
+// been modified after the time the client passed in X-If-Unmodified-Since.
+
+type PreconditionFailedError struct {
+	LastModified float64
+}
+
+func (e *PreconditionFailedError) Error() string {
+	return fmt.Sprintf("Precondition failed: modified at %.2f", e.LastModified)
+}
+
+// Internal buckets. Their names contain a colon so that they cannot
+// clash with a collection, see index.go.
+
+const (
+	COLLECTIONS_BUCKET = "Meta:Collections"
+	BATCHES_BUCKET     = "Meta:Batches"
+	STORAGE_BUCKET     = "Meta:Storage"
+)
 
 // Utilities
 
@@ -35,18 +66,333 @@ func getEncodedObject(bucket *bolt.Bucket, key string, value interface{}) error
 	return json.Unmarshal(data, &value)
 }
 
+func getCollectionLastModified(tx *bolt.Tx, collectionName string) (float64, error) {
+	metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+	if metaBucket == nil {
+		return 0, nil
+	}
+	var collectionInfo CollectionInfo
+	if err := getEncodedObject(metaBucket, collectionName, &collectionInfo); err != nil {
+		if err == ObjectNotFoundErr {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return collectionInfo.LastModified, nil
+}
+
+// The last modified time of the storage is the latest of the times at
+// which a collection was written and the time of the last delete of a
+// collection or of the whole storage. Deletes are recorded separately
+// because the collection info is gone after them.
+
+func getStorageLastModified(tx *bolt.Tx) (float64, error) {
+	var lastModified float64
+	if storageBucket := tx.Bucket([]byte(STORAGE_BUCKET)); storageBucket != nil {
+		if err := getEncodedObject(storageBucket, "LastModified", &lastModified); err != nil && err != ObjectNotFoundErr {
+			return 0, err
+		}
+	}
+	metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+	if metaBucket == nil {
+		return lastModified, nil
+	}
+	err := metaBucket.ForEach(func(k, v []byte) error {
+		var collectionInfo CollectionInfo
+		if err := json.Unmarshal(v, &collectionInfo); err != nil {
+			return err
+		}
+		if collectionInfo.LastModified > lastModified {
+			lastModified = collectionInfo.LastModified
+		}
+		return nil
+	})
+	return lastModified, err
+}
+
+func setStorageLastModified(tx *bolt.Tx, lastModified float64) error {
+	storageBucket, err := tx.CreateBucketIfNotExists([]byte(STORAGE_BUCKET))
+	if err != nil {
+		return err
+	}
+	return putEncodedObject(storageBucket, "LastModified", lastModified)
+}
+
+// Update the collection's entry in the Collections bucket. A zero
+// lastModified keeps the current one. The usageDelta and countDelta are
+// added to the number of payload bytes and of objects stored in the
+// collection.
+
+func updateCollectionInfo(tx *bolt.Tx, collectionName string, lastModified float64, usageDelta int, countDelta int) error {
+	metaBucket, err := tx.CreateBucketIfNotExists([]byte(COLLECTIONS_BUCKET))
+	if err != nil {
+		return err
+	}
+	var collectionInfo CollectionInfo
+	if err := getEncodedObject(metaBucket, collectionName, &collectionInfo); err != nil && err != ObjectNotFoundErr {
+		return err
+	}
+	if lastModified != 0 {
+		collectionInfo.LastModified = lastModified
+	}
+	collectionInfo.Usage += usageDelta
+	if collectionInfo.Usage < 0 {
+		collectionInfo.Usage = 0
+	}
+	collectionInfo.Count += countDelta
+	if collectionInfo.Count < 0 {
+		collectionInfo.Count = 0
+	}
+	return putEncodedObject(metaBucket, collectionName, collectionInfo)
+}
+
+func setCollectionUsage(tx *bolt.Tx, collectionName string, usage int, count int) error {
+	metaBucket, err := tx.CreateBucketIfNotExists([]byte(COLLECTIONS_BUCKET))
+	if err != nil {
+		return err
+	}
+	var collectionInfo CollectionInfo
+	if err := getEncodedObject(metaBucket, collectionName, &collectionInfo); err != nil && err != ObjectNotFoundErr {
+		return err
+	}
+	collectionInfo.Usage = usage
+	collectionInfo.Count = count
+	return putEncodedObject(metaBucket, collectionName, collectionInfo)
+}
+
+func getStorageUsage(tx *bolt.Tx) (int, error) {
+	usage := 0
+	metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+	if metaBucket == nil {
+		return 0, nil
+	}
+	err := metaBucket.ForEach(func(k, v []byte) error {
+		var collectionInfo CollectionInfo
+		if err := json.Unmarshal(v, &collectionInfo); err != nil {
+			return err
+		}
+		usage += collectionInfo.Usage
+		return nil
+	})
+	return usage, err
+}
+
+// Writes that grow the storage are checked against the quota after they
+// have been applied, so that the transaction can be rolled back.
+
+func checkQuota(tx *bolt.Tx, quota int, usageDelta int) error {
+	if quota == 0 || usageDelta <= 0 {
+		return nil
+	}
+	usage, err := getStorageUsage(tx)
+	if err != nil {
+		return err
+	}
+	if usage > quota {
+		return OverQuotaErr
+	}
+	return nil
+}
+
+// Check the X-If-Unmodified-Since precondition for a collection. An
+// unmodifiedSince of zero means the write is unconditional.
+
+func checkCollectionUnmodifiedSince(tx *bolt.Tx, collectionName string, unmodifiedSince float64) error {
+	if unmodifiedSince == 0 {
+		return nil
+	}
+	lastModified, err := getCollectionLastModified(tx, collectionName)
+	if err != nil {
+		return err
+	}
+	if lastModified > unmodifiedSince {
+		return &PreconditionFailedError{LastModified: lastModified}
+	}
+	return nil
+}
+
+// Same as above but for operations on the whole storage.
+
+func checkStorageUnmodifiedSince(tx *bolt.Tx, unmodifiedSince float64) error {
+	if unmodifiedSince == 0 {
+		return nil
+	}
+	lastModified, err := getStorageLastModified(tx)
+	if err != nil {
+		return err
+	}
+	if lastModified > unmodifiedSince {
+		return &PreconditionFailedError{LastModified: lastModified}
+	}
+	return nil
+}
+
+// Returns the modified time for a write to the collection, see
+// nextModified.
+
+func nextCollectionModified(tx *bolt.Tx, collectionName string, modified float64) (float64, error) {
+	lastModified, err := getCollectionLastModified(tx, collectionName)
+	if err != nil {
+		return 0, err
+	}
+	return nextModified(lastModified, modified), nil
+}
+
+// If the object already exists then this is an update and we need to
+// merge.
+
+func mergeExistingObject(objectsBucket *bolt.Bucket, object *Object, now float64) error {
+	encodedExistingObject := objectsBucket.Get([]byte(object.Id))
+	if encodedExistingObject == nil {
+		mergeObject(object, nil, now)
+		return nil
+	}
+	var existingObject Object
+	if err := json.Unmarshal(encodedExistingObject, &existingObject); err != nil {
+		return err
+	}
+	mergeObject(object, &existingObject, now)
+	return nil
+}
+
 // Object Database
 
 type ObjectDatabase struct {
-	db *bolt.DB
+	db    *bolt.DB
+	quota int
 }
 
-func OpenObjectDatabase(path string) (*ObjectDatabase, error) {
-	db, err := bolt.Open(path, 0600, nil)
+// How long to wait for the file lock of a database that is held by
+// another process, like a backup or a second server on the same files.
+const OPEN_TIMEOUT = 5 * time.Second
+
+// Open the database at path. Writes that would grow the total payload
+// bytes stored beyond quota are rejected with an OverQuotaErr. A quota
+// of zero means there is no limit.
+
+func OpenObjectDatabase(path string, quota int) (*ObjectDatabase, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: OPEN_TIMEOUT})
 	if err != nil {
 		return nil, err
 	}
-	return &ObjectDatabase{db: db}, nil
+	if err := renameInternalBuckets(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := indexCollections(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := countCollectionObjects(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &ObjectDatabase{db: db, quota: quota}, nil
+}
+
+// Databases written before the internal buckets were renamed keep the
+// collection info in a Collections bucket and staged batches in a
+// Batches bucket. Move the collection info over. Batches are short
+// lived, so they are thrown away, unless Batches is a collection.
+
+func renameInternalBuckets(db *bolt.DB) error {
+	var rename bool
+	db.View(func(tx *bolt.Tx) error {
+		rename = tx.Bucket([]byte("Collections")) != nil && tx.Bucket([]byte(COLLECTIONS_BUCKET)) == nil
+		return nil
+	})
+	if !rename {
+		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		metaBucket, err := tx.CreateBucket([]byte(COLLECTIONS_BUCKET))
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte("Collections")).ForEach(func(k, v []byte) error {
+			return metaBucket.Put(k, v)
+		})
+		if err != nil {
+			return err
+		}
+		if err := tx.DeleteBucket([]byte("Collections")); err != nil {
+			return err
+		}
+		if tx.Bucket([]byte("Batches")) != nil && metaBucket.Get([]byte("Batches")) == nil {
+			return tx.DeleteBucket([]byte("Batches"))
+		}
+		return nil
+	})
+}
+
+// Collections written before indexes existed have no index buckets.
+// Build them, so that sorting never has to fall back to id order.
+
+func indexCollections(db *bolt.DB) error {
+	var collectionNames []string
+	err := db.View(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+		if metaBucket == nil {
+			return nil
+		}
+		return metaBucket.ForEach(func(k, v []byte) error {
+			buckets := getCollectionBuckets(tx, string(k))
+			if buckets != nil && (buckets.modified == nil || buckets.sortIndex == nil) {
+				collectionNames = append(collectionNames, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(collectionNames) == 0 {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, collectionName := range collectionNames {
+			if _, err := createCollectionBuckets(tx, collectionName); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Collection info written before object counts were kept has no Count.
+// Count the keys of those collections once, which includes expired
+// objects, like the count does until the reaper deletes them.
+
+func countCollectionObjects(db *bolt.DB) error {
+	var collectionNames []string
+	err := db.View(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+		if metaBucket == nil {
+			return nil
+		}
+		return metaBucket.ForEach(func(k, v []byte) error {
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(v, &fields); err != nil {
+				return err
+			}
+			if _, ok := fields["Count"]; !ok {
+				collectionNames = append(collectionNames, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil || len(collectionNames) == 0 {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, collectionName := range collectionNames {
+			count := 0
+			if objectsBucket := tx.Bucket([]byte(collectionName)); objectsBucket != nil {
+				count = objectsBucket.Stats().KeyN
+			}
+			if err := updateCollectionInfo(tx, collectionName, 0, 0, count); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 func (odb *ObjectDatabase) Close() error {
@@ -55,14 +401,20 @@ func (odb *ObjectDatabase) Close() error {
 
 //
 
+// Usage is the number of payload bytes stored in the collection and
+// Count the number of objects. Both include expired objects until they
+// are deleted by the reaper.
+
 type CollectionInfo struct {
 	LastModified float64
+	Usage        int
+	Count        int
 }
 
 func (odb *ObjectDatabase) GetCollectionsInfo() (map[string]CollectionInfo, error) {
 	infos := make(map[string]CollectionInfo)
 	return infos, odb.db.View(func(tx *bolt.Tx) error {
-		metaBucket := tx.Bucket([]byte("Collections"))
+		metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
 		if metaBucket == nil {
 			return nil
 		}
@@ -77,125 +429,295 @@ func (odb *ObjectDatabase) GetCollectionsInfo() (map[string]CollectionInfo, erro
 	})
 }
 
-//
+func (odb *ObjectDatabase) GetCollectionLastModified(collectionName string) (float64, error) {
+	var lastModified float64
+	err := odb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lastModified, err = getCollectionLastModified(tx, collectionName)
+		return err
+	})
+	return lastModified, err
+}
+
+// Includes deletes, so unlike the collection info it moves forward when
+// a collection is deleted.
+
+func (odb *ObjectDatabase) GetStorageLastModified() (float64, error) {
+	var lastModified float64
+	err := odb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		lastModified, err = getStorageLastModified(tx)
+		return err
+	})
+	return lastModified, err
+}
+
+// Returns the number of payload bytes stored and the quota, which is
+// zero if there is no limit.
+
+func (odb *ObjectDatabase) GetUsage() (int, int, error) {
+	var usage int
+	err := odb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		usage, err = getStorageUsage(tx)
+		return err
+	})
+	return usage, odb.quota, err
+}
+
+// Returns the object counts kept in the collection info. Expired
+// objects are counted until the reaper deletes them. Collections
+// without objects are left out, like in the Postgres backend.
 
 func (odb *ObjectDatabase) GetCollectionCounts() (map[string]int, error) {
 	counts := make(map[string]int)
 	return counts, odb.db.View(func(tx *bolt.Tx) error {
-		metaBucket := tx.Bucket([]byte("Collections"))
+		metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
 		if metaBucket == nil {
 			return nil
 		}
 		return metaBucket.ForEach(func(k, v []byte) error {
-			objectsBucket := tx.Bucket(k)
-			if objectsBucket != nil {
-				stats := objectsBucket.Stats()
-				counts[string(k)] = stats.KeyN
+			var collectionInfo CollectionInfo
+			if err := json.Unmarshal(v, &collectionInfo); err != nil {
+				return err
+			}
+			if collectionInfo.Count > 0 {
+				counts[string(k)] = collectionInfo.Count
 			}
 			return nil
 		})
 	})
 }
 
+const (
+	SORT_NEWEST = "newest"
+	SORT_OLDEST = "oldest"
+	SORT_INDEX  = "index"
+)
+
+// An offset is an opaque token that lets a client continue reading a
+// collection where the previous page ended. It records the collection
+// last modified time when the first page was read, so that objects
+// modified during the walk are left out instead of showing up twice,
+// and the position of the last object returned.
+
+type Offset struct {
+	Snapshot float64
+	Sort     string
+	Position []byte
+}
+
+func (offset *Offset) String() string {
+	return fmt.Sprintf("%.2f:%s:%s", offset.Snapshot, offset.Sort, base64.RawURLEncoding.EncodeToString(offset.Position))
+}
+
+func ParseOffset(value string) (*Offset, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return nil, InvalidOffsetErr
+	}
+	snapshot, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, InvalidOffsetErr
+	}
+	position, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(position) == 0 {
+		return nil, InvalidOffsetErr
+	}
+	return &Offset{Snapshot: snapshot, Sort: parts[1], Position: position}, nil
+}
+
 type GetObjectsOptions struct {
-	Full  bool
-	Limit int
-	Newer float64
-	Ids   []string
+	Full   bool
+	Limit  int
+	Newer  float64
+	Older  float64
+	Ids    []string
+	Sort   string
+	Offset *Offset
 }
 
 func ParseGetObjectsOptions(r *http.Request) (*GetObjectsOptions, error) {
-	// TODO: This should also do parameter validation
+	sort, err := parseSort(r)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := parseOffset(r)
+	if err != nil {
+		return nil, err
+	}
+	if offset != nil && offset.Sort != sort {
+		return nil, InvalidOffsetErr
+	}
 	return &GetObjectsOptions{
-		Full:  parseFull(r),
-		Limit: parseLimit(r),
-		Newer: parseNewer(r),
-		Ids:   parseIds(r),
+		Full:   parseFull(r),
+		Limit:  parseLimit(r),
+		Newer:  parseNewer(r),
+		Older:  parseOlder(r),
+		Ids:    parseIds(r),
+		Sort:   sort,
+		Offset: offset,
 	}, nil
 }
 
-func (odb *ObjectDatabase) GetObjects(collectionName string, options *GetObjectsOptions) ([]Object, error) {
-	objects := []Object{}
-	return objects, odb.db.View(func(tx *bolt.Tx) error {
-		objectsBucket := tx.Bucket([]byte(collectionName))
-		if objectsBucket == nil {
-			return nil
-		}
-		if len(options.Ids) == 0 {
-			err := objectsBucket.ForEach(func(k, v []byte) error {
-				var object Object
-				if err := getEncodedObject(objectsBucket, string(k), &object); err != nil {
-					return err
-				}
-				if object.Modified > options.Newer {
-					objects = append(objects, object)
-					if len(objects) == options.Limit {
-						return IterationCancelledErr
-					}
-				}
-				return nil
-			})
-			if err == IterationCancelledErr {
-				return nil
+// Describes the page returned by GetObjects and GetObjectIds. Records
+// is the number of objects that match the options from the start of
+// the page on, including the ones that did not fit in this page.
+// NextOffset is empty if there are no more objects.
+
+type PageInfo struct {
+	Records    int
+	NextOffset string
+}
+
+// Walks the collection for GetObjects and GetObjectIds. Calls fn for
+// the first options.Limit objects and keeps counting the rest.
+
+func forEachObjectPage(tx *bolt.Tx, collectionName string, options *GetObjectsOptions, now float64, fn func(object *Object)) (PageInfo, error) {
+	var info PageInfo
+
+	buckets := getCollectionBuckets(tx, collectionName)
+	if buckets == nil {
+		return info, nil
+	}
+
+	snapshot, err := getCollectionLastModified(tx, collectionName)
+	if err != nil {
+		return info, err
+	}
+	if options.Offset != nil {
+		snapshot = options.Offset.Snapshot
+	}
+
+	var lastPosition []byte
+
+	err = buckets.forEach(options, now, func(object *Object, position []byte) error {
+		if options.Limit > 0 && info.Records >= options.Limit {
+			if info.NextOffset == "" {
+				info.NextOffset = (&Offset{Snapshot: snapshot, Sort: options.Sort, Position: lastPosition}).String()
 			}
-			return err
 		} else {
-			for _, objectId := range options.Ids {
-				if data := objectsBucket.Get([]byte(objectId)); data != nil {
-					var object Object
-					if err := json.Unmarshal(data, &object); err != nil {
-						return err
-					}
-					if object.Modified > options.Newer {
-						objects = append(objects, object)
-					}
-				}
-			}
-			return nil
+			fn(object)
+			lastPosition = append([]byte{}, position...)
 		}
+		info.Records++
+		return nil
 	})
+	return info, err
 }
 
-func (odb *ObjectDatabase) GetObjectIds(collectionName string, options *GetObjectsOptions) ([]string, error) {
+func (odb *ObjectDatabase) GetObjects(collectionName string, options *GetObjectsOptions) ([]Object, PageInfo, error) {
+	objects := []Object{}
+	var info PageInfo
+	err := odb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = forEachObjectPage(tx, collectionName, options, timestampNow(), func(object *Object) {
+			objects = append(objects, *object)
+		})
+		return err
+	})
+	return objects, info, err
+}
+
+func (odb *ObjectDatabase) GetObjectIds(collectionName string, options *GetObjectsOptions) ([]string, PageInfo, error) {
 	objectIds := []string{}
-	return objectIds, odb.db.View(func(tx *bolt.Tx) error {
-		objectsBucket := tx.Bucket([]byte(collectionName))
-		if objectsBucket == nil {
-			return nil
+	var info PageInfo
+	err := odb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = forEachObjectPage(tx, collectionName, options, timestampNow(), func(object *Object) {
+			objectIds = append(objectIds, object.Id)
+		})
+		return err
+	})
+	return objectIds, info, err
+}
+
+// Objects are streamed in chunks of STREAM_CHUNK_SIZE, each read in its
+// own transaction, and written to the client in between. A read
+// transaction that stays open while a slow client reads the response
+// keeps bolt from reusing freed pages and blocks writes that need to
+// grow the database file. The trade-off is that the response is not a
+// single snapshot of the collection. Like with offsets, objects that are
+// modified while streaming are skipped, and objects that are deleted
+// while streaming are left out, so fewer objects than X-Weave-Records
+// can be returned.
+
+const STREAM_CHUNK_SIZE = 100
+
+// Walks the page of objects described by the options without collecting
+// them. The page info is passed to start before the first object so
+// that response headers can be written.
+
+func (odb *ObjectDatabase) StreamObjects(collectionName string, options *GetObjectsOptions, start func(info PageInfo) error, fn func(object *Object) error) error {
+	now := timestampNow()
+
+	var info PageInfo
+	chunkOptions := *options
+	err := odb.db.View(func(tx *bolt.Tx) error {
+		var err error
+		info, err = forEachObjectPage(tx, collectionName, options, now, func(object *Object) {})
+		if err != nil {
+			return err
 		}
-		if len(options.Ids) == 0 {
-			err := objectsBucket.ForEach(func(k, v []byte) error {
-				var object Object
-				if err := getEncodedObject(objectsBucket, string(k), &object); err != nil {
-					return err
-				}
-				if object.Modified > options.Newer {
-					objectIds = append(objectIds, string(k))
-					if len(objectIds) == options.Limit {
-						return IterationCancelledErr
-					}
+		// Later chunks resume from an offset, which needs a snapshot
+		if chunkOptions.Offset == nil {
+			snapshot, err := getCollectionLastModified(tx, collectionName)
+			if err != nil {
+				return err
+			}
+			chunkOptions.Offset = &Offset{Snapshot: snapshot, Sort: options.Sort}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := start(info); err != nil {
+		return err
+	}
+
+	remaining := info.Records
+	if options.Limit > 0 && remaining > options.Limit {
+		remaining = options.Limit
+	}
+
+	for remaining > 0 {
+		var chunk []Object
+		var position []byte
+		err := odb.db.View(func(tx *bolt.Tx) error {
+			buckets := getCollectionBuckets(tx, collectionName)
+			if buckets == nil {
+				return nil
+			}
+			err := buckets.forEach(&chunkOptions, now, func(object *Object, objectPosition []byte) error {
+				if len(chunk) == STREAM_CHUNK_SIZE || len(chunk) == remaining {
+					return IterationCancelledErr
 				}
+				chunk = append(chunk, *object)
+				position = append([]byte{}, objectPosition...)
 				return nil
 			})
 			if err == IterationCancelledErr {
 				return nil
 			}
 			return err
-		} else {
-			for _, objectId := range options.Ids {
-				if data := objectsBucket.Get([]byte(objectId)); data != nil {
-					var object Object
-					if err := json.Unmarshal(data, &object); err != nil {
-						return err
-					}
-					if object.Modified > options.Newer {
-						objectIds = append(objectIds, objectId)
-					}
-				}
+		})
+		if err != nil {
+			return err
+		}
+		if len(chunk) == 0 {
+			return nil // The rest was deleted while streaming
+		}
+		for i := range chunk {
+			if err := fn(&chunk[i]); err != nil {
+				return err
 			}
-			return nil
 		}
-	})
+		remaining -= len(chunk)
+		chunkOptions.Offset = &Offset{Snapshot: chunkOptions.Offset.Snapshot, Sort: options.Sort, Position: position}
+	}
+
+	return nil
 }
 
 //
@@ -211,160 +733,380 @@ func (odb *ObjectDatabase) GetObject(collectionName, objectId string) (Object, e
 		if encodedObject == nil {
 			return ObjectNotFoundErr
 		}
-		return json.Unmarshal(encodedObject, &object)
+		if err := json.Unmarshal(encodedObject, &object); err != nil {
+			return err
+		}
+		if object.Expired(timestampNow()) {
+			return ObjectNotFoundErr
+		}
+		return nil
 	})
 }
 
 //
 
-func (odb *ObjectDatabase) PutObject(collectionName string, object Object) (Object, error) {
-	return object, odb.db.Update(func(tx *bolt.Tx) error {
-		objectsBucket, err := tx.CreateBucketIfNotExists([]byte(collectionName))
-		if err != nil {
+func (odb *ObjectDatabase) PutObject(collectionName string, object Object, modified float64, unmodifiedSince float64) (Object, error) {
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
 			return err
 		}
 
-		// If the object already exists then this is an update and we need to merge
-		var existingObject Object
-		encodedExistingObject := objectsBucket.Get([]byte(object.Id))
-		if encodedExistingObject == nil {
-			if object.Modified == 0 {
-				object.Modified = timestampNow()
-			}
-			if object.TTL == 0 {
-				object.TTL = 2100000000
-			}
-		} else {
-			if err := json.Unmarshal(encodedExistingObject, &existingObject); err != nil {
-				return err
-			}
-			if object.Modified == 0.0 {
-				object.Modified = existingObject.Modified
-			}
-			if object.TTL == 0 {
-				object.TTL = existingObject.TTL
-			}
-			if object.Payload == "" {
-				object.Payload = existingObject.Payload
-			}
-			if object.SortIndex == 0 {
-				object.SortIndex = existingObject.SortIndex
-			}
+		modified, err := nextCollectionModified(tx, collectionName, modified)
+		if err != nil {
+			return err
 		}
+		object.Modified = modified // Always set the object's modified time
 
-		if err := putEncodedObject(objectsBucket, object.Id, object); err != nil {
+		buckets, err := createCollectionBuckets(tx, collectionName)
+		if err != nil {
 			return err
 		}
 
-		// Update collections info
+		if err := mergeExistingObject(buckets.objects, &object, modified); err != nil {
+			return err
+		}
 
-		metaBucket, err := tx.CreateBucketIfNotExists([]byte("Collections"))
+		usageDelta, countDelta, err := buckets.put(&object)
 		if err != nil {
 			return err
 		}
 
-		if err := putEncodedObject(metaBucket, collectionName, CollectionInfo{LastModified: object.Modified}); err != nil {
+		// Update collections info
+
+		if err := updateCollectionInfo(tx, collectionName, object.Modified, usageDelta, countDelta); err != nil {
 			return err
 		}
 
-		return nil
+		return checkQuota(tx, odb.quota, usageDelta)
 	})
+	return object, err
 }
 
 //
 
-func (odb *ObjectDatabase) DeleteObject(collectionName, objectId string) error {
+func (odb *ObjectDatabase) DeleteObject(collectionName, objectId string, modified float64, unmodifiedSince float64) error {
 	return odb.db.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists([]byte(collectionName))
-		if err != nil {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
 			return err
 		}
 
-		encodedObject := bucket.Get([]byte(objectId))
-		if encodedObject == nil {
+		if tx.Bucket([]byte(collectionName)) == nil {
 			return ObjectNotFoundErr
 		}
 
-		return bucket.Delete([]byte(objectId))
+		modified, err := nextCollectionModified(tx, collectionName, modified)
+		if err != nil {
+			return err
+		}
+
+		buckets, err := createCollectionBuckets(tx, collectionName)
+		if err != nil {
+			return err
+		}
+
+		usageDelta, err := buckets.delete(objectId)
+		if err != nil {
+			return err
+		}
+
+		// Update meta/info
+		return updateCollectionInfo(tx, collectionName, modified, usageDelta, -1)
 	})
 }
 
 //
 
-func (odb *ObjectDatabase) DeleteObjects(collectionName string, objectIds []string) (float64, error) {
-	var lastModified float64 = timestampNow()
-	return lastModified, odb.db.Update(func(tx *bolt.Tx) error {
+func (odb *ObjectDatabase) DeleteObjects(collectionName string, objectIds []string, modified float64, unmodifiedSince float64) (float64, error) {
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
+			return err
+		}
 		// The bucket must exist
-		bucket := tx.Bucket([]byte(collectionName))
-		if bucket == nil {
+		if tx.Bucket([]byte(collectionName)) == nil {
 			return CollectionNotFoundErr
 		}
+		var err error
+		if modified, err = nextCollectionModified(tx, collectionName, modified); err != nil {
+			return err
+		}
+		buckets, err := createCollectionBuckets(tx, collectionName)
+		if err != nil {
+			return err
+		}
 		// Delete the specified objects
+		usageDelta, countDelta := 0, 0
 		for _, objectId := range objectIds {
-			if err := bucket.Delete([]byte(objectId)); err != nil {
+			delta, err := buckets.delete(objectId)
+			if err == ObjectNotFoundErr {
+				continue
+			} else if err != nil {
 				return err
 			}
+			usageDelta += delta
+			countDelta--
 		}
 		// Update meta/info
-		metaBucket, err := tx.CreateBucketIfNotExists([]byte("Collections"))
-		if err != nil {
+		return updateCollectionInfo(tx, collectionName, modified, usageDelta, countDelta)
+	})
+	return modified, err
+}
+
+// The outcome of writing a set of objects. Objects that could not be
+// stored are listed in Failed, with the reason, instead of failing the
+// whole write.
+
+type PutObjectsResult struct {
+	Modified float64
+	Success  []string
+	Failed   map[string]string
+}
+
+func (odb *ObjectDatabase) PutObjects(collectionName string, objects []Object, modified float64, unmodifiedSince float64) (PutObjectsResult, error) {
+	var result PutObjectsResult
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
 			return err
 		}
-		return putEncodedObject(metaBucket, collectionName, CollectionInfo{LastModified: lastModified})
+		var err error
+		result, err = putObjects(tx, collectionName, objects, modified, odb.quota)
+		return err
 	})
+	return result, err
 }
 
-func (odb *ObjectDatabase) PutObjects(collectionName string, objects []Object) (float64, error) {
-	var lastModified float64 = timestampNow()
-	return lastModified, odb.db.Update(func(tx *bolt.Tx) error {
-		objectsBucket, err := tx.CreateBucketIfNotExists([]byte(collectionName))
+// Keep only the last object for each id, in the order in which the ids
+// first appear, so that a later object replaces an earlier one.
+
+func uniqueObjects(objects []Object) []Object {
+	positions := make(map[string]int)
+	var unique []Object
+	for _, object := range objects {
+		if position, ok := positions[object.Id]; ok {
+			unique[position] = object
+		} else {
+			positions[object.Id] = len(unique)
+			unique = append(unique, object)
+		}
+	}
+	return unique
+}
+
+func putObjects(tx *bolt.Tx, collectionName string, objects []Object, modified float64, quota int) (PutObjectsResult, error) {
+	lastModified, err := getCollectionLastModified(tx, collectionName)
+	if err != nil {
+		return PutObjectsResult{}, err
+	}
+
+	result := PutObjectsResult{
+		Modified: lastModified,
+		Success:  []string{},
+		Failed:   map[string]string{},
+	}
+
+	// Writing nothing leaves the collection alone
+	if len(objects) == 0 {
+		return result, nil
+	}
+
+	modified = nextModified(lastModified, modified)
+	result.Modified = modified
+
+	buckets, err := createCollectionBuckets(tx, collectionName)
+	if err != nil {
+		return result, err
+	}
+
+	usageDelta, countDelta := 0, 0
+	for _, object := range uniqueObjects(objects) {
+		// In practice this only fails when the existing object cannot be
+		// decoded, which is detected before anything is written
+		if err := mergeExistingObject(buckets.objects, &object, modified); err != nil {
+			log.Printf("Cannot store object %s/%s: %v", collectionName, object.Id, err)
+			result.Failed[object.Id] = "cannot replace existing object"
+			continue
+		}
+
+		object.Modified = modified // Always set the object's modified time
+
+		delta, added, err := buckets.put(&object)
 		if err != nil {
-			return err
+			log.Printf("Cannot store object %s/%s: %v", collectionName, object.Id, err)
+			result.Failed[object.Id] = "cannot replace existing object"
+			continue
 		}
+		usageDelta += delta
+		countDelta += added
+		result.Success = append(result.Success, object.Id)
+	}
 
-		for _, object := range objects {
-			// If the object already exists then this is an update and we need to merge
-			var existingObject Object
-			encodedExistingObject := objectsBucket.Get([]byte(object.Id))
-			if encodedExistingObject == nil {
-				if object.TTL == 0 {
-					object.TTL = 2100000000
-				}
-			} else {
-				if err := json.Unmarshal(encodedExistingObject, &existingObject); err != nil {
-					return err
-				}
-				if object.TTL == 0 {
-					object.TTL = existingObject.TTL
-				}
-				if object.Payload == "" {
-					object.Payload = existingObject.Payload
-				}
-				if object.SortIndex == 0 {
-					object.SortIndex = existingObject.SortIndex
-				}
-			}
+	// Update collections info, unless every object failed
 
-			object.Modified = lastModified // Always set the object's modified time
+	if len(result.Success) == 0 {
+		result.Modified = lastModified
+		return result, nil
+	}
 
-			if err := putEncodedObject(objectsBucket, object.Id, object); err != nil {
-				return err
-			}
+	if err := updateCollectionInfo(tx, collectionName, modified, usageDelta, countDelta); err != nil {
+		return result, err
+	}
+
+	return result, checkQuota(tx, quota, usageDelta)
+}
+
+// Batches. Objects uploaded with ?batch are staged in the Batches
+// bucket and only written to the collection when the batch is
+// committed. Batches that are not committed before they expire are
+// thrown away.
+
+const BATCH_TTL = 2 * 60 * 60
+
+type Batch struct {
+	Collection string
+	Expires    float64
+	Objects    []Object
+}
+
+type BatchLimits struct {
+	MaxTotalRecords int
+	MaxTotalBytes   int
+}
+
+func (batch *Batch) checkLimits(objects []Object, limits BatchLimits) error {
+	if len(batch.Objects)+len(objects) > limits.MaxTotalRecords {
+		return BatchTooLargeErr
+	}
+	totalBytes := 0
+	for _, object := range batch.Objects {
+		totalBytes += len(object.Payload)
+	}
+	for _, object := range objects {
+		totalBytes += len(object.Payload)
+	}
+	if totalBytes > limits.MaxTotalBytes {
+		return BatchTooLargeErr
+	}
+	return nil
+}
+
+func getBatch(tx *bolt.Tx, collectionName, batchId string, now float64) (*Batch, error) {
+	batchesBucket := tx.Bucket([]byte(BATCHES_BUCKET))
+	if batchesBucket == nil {
+		return nil, BatchNotFoundErr
+	}
+	var batch Batch
+	if err := getEncodedObject(batchesBucket, batchId, &batch); err != nil {
+		if err == ObjectNotFoundErr {
+			return nil, BatchNotFoundErr
 		}
+		return nil, err
+	}
+	if batch.Collection != collectionName {
+		return nil, BatchNotFoundErr
+	}
+	if batch.Expires <= now {
+		return nil, BatchNotFoundErr
+	}
+	return &batch, nil
+}
 
-		// Update collections info
+func deleteExpiredBatches(batchesBucket *bolt.Bucket, now float64) error {
+	var expiredBatchIds [][]byte
+	err := batchesBucket.ForEach(func(k, v []byte) error {
+		var batch Batch
+		if err := json.Unmarshal(v, &batch); err != nil {
+			return err
+		}
+		if batch.Expires <= now {
+			expiredBatchIds = append(expiredBatchIds, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, batchId := range expiredBatchIds {
+		if err := batchesBucket.Delete(batchId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		metaBucket, err := tx.CreateBucketIfNotExists([]byte("Collections"))
+// Create a new batch for the collection, staging the given objects. Returns the batch id.
+
+func (odb *ObjectDatabase) CreateBatch(collectionName string, objects []Object, modified float64, unmodifiedSince float64) (string, error) {
+	var batchId string
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
+			return err
+		}
+		batchesBucket, err := tx.CreateBucketIfNotExists([]byte(BATCHES_BUCKET))
+		if err != nil {
+			return err
+		}
+		if err := deleteExpiredBatches(batchesBucket, modified); err != nil {
+			return err
+		}
+		sequence, err := batchesBucket.NextSequence()
 		if err != nil {
 			return err
 		}
+		batchId = strconv.FormatUint(sequence, 10)
+		batch := Batch{
+			Collection: collectionName,
+			Expires:    modified + BATCH_TTL,
+			Objects:    objects,
+		}
+		return putEncodedObject(batchesBucket, batchId, batch)
+	})
+	return batchId, err
+}
+
+// Stage more objects in an existing batch. Returns a BatchNotFoundErr
+// if the batch does not exist, has expired or belongs to another
+// collection. Returns a BatchTooLargeErr if the batch would grow
+// beyond the limits.
 
-		if err := putEncodedObject(metaBucket, collectionName, CollectionInfo{LastModified: lastModified}); err != nil {
+func (odb *ObjectDatabase) AppendBatch(collectionName string, batchId string, objects []Object, modified float64, unmodifiedSince float64, limits BatchLimits) error {
+	return odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
+			return err
+		}
+		batch, err := getBatch(tx, collectionName, batchId, modified)
+		if err != nil {
 			return err
 		}
+		if err := batch.checkLimits(objects, limits); err != nil {
+			return err
+		}
+		batch.Objects = append(batch.Objects, objects...)
+		return putEncodedObject(tx.Bucket([]byte(BATCHES_BUCKET)), batchId, batch)
+	})
+}
 
-		return nil
+// Write all staged objects plus the given objects to the collection in
+// one transaction with a single modification time and remove the batch.
+
+func (odb *ObjectDatabase) CommitBatch(collectionName string, batchId string, objects []Object, modified float64, unmodifiedSince float64, limits BatchLimits) (PutObjectsResult, error) {
+	var result PutObjectsResult
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
+			return err
+		}
+		batch, err := getBatch(tx, collectionName, batchId, modified)
+		if err != nil {
+			return err
+		}
+		if err := batch.checkLimits(objects, limits); err != nil {
+			return err
+		}
+		result, err = putObjects(tx, collectionName, append(batch.Objects, objects...), modified, odb.quota)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket([]byte(BATCHES_BUCKET)).Delete([]byte(batchId))
 	})
+	return result, err
 }
 
 //
@@ -373,52 +1115,125 @@ func (odb *ObjectDatabase) PutObjects(collectionName string, objects []Object) (
 // modified for the storage. Returns the global last modified. Returns
 // a CollectionNotFoundErr if the collection does not exist.
 
-func (odb *ObjectDatabase) DeleteCollection(collectionName string) (float64, error) {
-	var lastModified float64
-	return lastModified, odb.db.Update(func(tx *bolt.Tx) error {
+func (odb *ObjectDatabase) DeleteCollection(collectionName string, modified float64, unmodifiedSince float64) (float64, error) {
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		if err := checkCollectionUnmodifiedSince(tx, collectionName, unmodifiedSince); err != nil {
+			return err
+		}
 		// Delete the complete bucket
-		bucket := tx.Bucket([]byte("Collections"))
-		if bucket == nil {
+		if tx.Bucket([]byte(collectionName)) == nil {
 			return CollectionNotFoundErr
 		}
-		if err := tx.DeleteBucket([]byte(collectionName)); err != nil {
+		storageLastModified, err := getStorageLastModified(tx)
+		if err != nil {
+			return err
+		}
+		modified = nextModified(storageLastModified, modified)
+		if err := deleteCollectionBuckets(tx, collectionName); err != nil {
 			return err
 		}
 		// Delete the collection from info/collections
-		metaBucket, err := tx.CreateBucketIfNotExists([]byte("Collections"))
+		metaBucket, err := tx.CreateBucketIfNotExists([]byte(COLLECTIONS_BUCKET))
 		if err != nil {
 			return err
 		}
 		if err := metaBucket.Delete([]byte(collectionName)); err != nil {
 			return err
 		}
-		// Find the last modified in info/collections
-		return metaBucket.ForEach(func(k, v []byte) error {
-			var collectionInfo CollectionInfo
-			if err := json.Unmarshal(v, &collectionInfo); err != nil {
-				return err
-			}
-			if collectionInfo.LastModified > lastModified {
-				lastModified = collectionInfo.LastModified
-			}
-			return nil
-		})
+		return setStorageLastModified(tx, modified)
 	})
+	return modified, err
 }
 
-// Delete all storage. We keep the database file but delete all collections in it.
+// Delete all storage. We keep the database file but delete all
+// collections in it. Only the time of the delete is kept.
 
-func (odb *ObjectDatabase) DeleteStorage() error {
+func (odb *ObjectDatabase) DeleteStorage(modified float64, unmodifiedSince float64) error {
 	return odb.db.Update(func(tx *bolt.Tx) error {
-		var err error
-		if metaBucket := tx.Bucket([]byte("Collections")); metaBucket != nil {
+		if err := checkStorageUnmodifiedSince(tx, unmodifiedSince); err != nil {
+			return err
+		}
+		storageLastModified, err := getStorageLastModified(tx)
+		if err != nil {
+			return err
+		}
+		modified = nextModified(storageLastModified, modified)
+		if metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET)); metaBucket != nil {
 			err = metaBucket.ForEach(func(k, v []byte) error {
-				return tx.DeleteBucket(k)
+				return deleteCollectionBuckets(tx, string(k))
 			})
 			if err == nil {
-				err = tx.DeleteBucket([]byte("Collections"))
+				err = tx.DeleteBucket([]byte(COLLECTIONS_BUCKET))
 			}
 		}
-		return err
+		if err == nil && tx.Bucket([]byte(BATCHES_BUCKET)) != nil {
+			err = tx.DeleteBucket([]byte(BATCHES_BUCKET))
+		}
+		if err != nil {
+			return err
+		}
+		return setStorageLastModified(tx, modified)
+	})
+}
+
+// Physically delete all objects whose TTL has passed. Returns the
+// number of objects that were deleted. The collection names are
+// collected first because updating the collection info while iterating
+// over the meta bucket is not allowed by bolt.
+
+func (odb *ObjectDatabase) DeleteExpiredObjects(now float64) (int, error) {
+	deleted := 0
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		metaBucket := tx.Bucket([]byte(COLLECTIONS_BUCKET))
+		if metaBucket == nil {
+			return nil
+		}
+		var collectionNames []string
+		err := metaBucket.ForEach(func(k, v []byte) error {
+			if tx.Bucket(k) != nil {
+				collectionNames = append(collectionNames, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, collectionName := range collectionNames {
+			buckets, err := createCollectionBuckets(tx, collectionName)
+			if err != nil {
+				return err
+			}
+			var expiredObjectIds []string
+			err = buckets.objects.ForEach(func(k, v []byte) error {
+				var object Object
+				if err := json.Unmarshal(v, &object); err != nil {
+					return err
+				}
+				if object.Expired(now) {
+					expiredObjectIds = append(expiredObjectIds, object.Id)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			usageDelta := 0
+			for _, objectId := range expiredObjectIds {
+				delta, err := buckets.delete(objectId)
+				if err != nil {
+					return err
+				}
+				usageDelta += delta
+			}
+			deleted += len(expiredObjectIds)
+			if len(expiredObjectIds) == 0 {
+				continue
+			}
+			if err := updateCollectionInfo(tx, collectionName, 0, usageDelta, -len(expiredObjectIds)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
+	return deleted, err
 }
@@ -0,0 +1,252 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var DatabasePoolClosedErr = errors.New("Database pool closed")
+
+// The database pool keeps the bolt databases of recently active users
+// open. Bolt holds an exclusive lock on the file, so all requests for a
+// user must share one handle. Handles are reference counted: a handle
+// is only closed when no request is using it, either because it is the
+// least recently used one and the pool is full, or because it has been
+// idle for longer than the idle timeout.
+//
+// Databases are opened without holding the mutex, so that a slow open
+// does not block the requests of other users. The handle is added to
+// the pool before it is opened and concurrent requests for the same
+// user wait for the open to finish.
+
+type DatabasePool struct {
+	databaseRootPath string
+	quota            int
+	maxOpen          int
+	idleTimeout      time.Duration
+	mutex            sync.Mutex
+	handles          map[uint64]*list.Element
+	lru              *list.List // Front is the most recently used handle
+	closed           bool
+	stop             chan struct{}
+}
+
+type pooledDatabase struct {
+	uid      uint64
+	odb      *ObjectDatabase
+	err      error
+	opened   chan struct{} // Closed when odb or err is set
+	refs     int
+	lastUsed time.Time
+}
+
+func NewDatabasePool(databaseRootPath string, quota int, maxOpen int, idleTimeout time.Duration) *DatabasePool {
+	pool := &DatabasePool{
+		databaseRootPath: databaseRootPath,
+		quota:            quota,
+		maxOpen:          maxOpen,
+		idleTimeout:      idleTimeout,
+		handles:          make(map[uint64]*list.Element),
+		lru:              list.New(),
+		stop:             make(chan struct{}),
+	}
+	// A zero idle timeout keeps handles open until they are evicted
+	if idleTimeout > 0 {
+		go pool.closeIdleDatabases()
+	}
+	return pool
+}
+
+// Returns the database of the user, opening it if needed. Every call
+// must be matched by a call to Release.
+
+func (pool *DatabasePool) Acquire(uid uint64) (Storage, error) {
+	return pool.acquire(uid)
+}
+
+func (pool *DatabasePool) acquire(uid uint64) (*ObjectDatabase, error) {
+	pool.mutex.Lock()
+
+	if pool.closed {
+		pool.mutex.Unlock()
+		return nil, DatabasePoolClosedErr
+	}
+
+	if element, ok := pool.handles[uid]; ok {
+		handle := element.Value.(*pooledDatabase)
+		handle.refs++
+		pool.lru.MoveToFront(element)
+		pool.mutex.Unlock()
+		// A handle that failed to open has already been removed from
+		// the pool, so there is nothing to release
+		<-handle.opened
+		return handle.odb, handle.err
+	}
+
+	pool.evict(pool.maxOpen - 1)
+
+	// The reference keeps the handle from being evicted while it opens
+	handle := &pooledDatabase{uid: uid, opened: make(chan struct{}), refs: 1}
+	element := pool.lru.PushFront(handle)
+	pool.handles[uid] = element
+	pool.mutex.Unlock()
+
+	path := fmt.Sprintf("%s/%d.db", pool.databaseRootPath, uid)
+	odb, err := OpenObjectDatabase(path, pool.quota)
+
+	pool.mutex.Lock()
+	handle.odb, handle.err = odb, err
+	if err != nil {
+		pool.lru.Remove(element)
+		delete(pool.handles, uid)
+	}
+	pool.mutex.Unlock()
+	close(handle.opened)
+
+	return odb, err
+}
+
+func (pool *DatabasePool) Release(uid uint64) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	element, ok := pool.handles[uid]
+	if !ok {
+		return
+	}
+
+	handle := element.Value.(*pooledDatabase)
+	handle.refs--
+	handle.lastUsed = time.Now()
+
+	if pool.closed {
+		pool.evict(0)
+	} else {
+		pool.evict(pool.maxOpen)
+	}
+}
+
+// Close unused handles, least recently used first, until at most
+// maxOpen are open. Handles that are in use are skipped, so the pool
+// can temporarily hold more than maxOpen handles when they are all
+// busy. Must be called with the mutex held.
+
+func (pool *DatabasePool) evict(maxOpen int) {
+	for element := pool.lru.Back(); element != nil && pool.lru.Len() > maxOpen; {
+		previous := element.Prev()
+		if handle := element.Value.(*pooledDatabase); handle.refs == 0 {
+			pool.remove(element)
+		}
+		element = previous
+	}
+}
+
+// Must be called with the mutex held.
+
+func (pool *DatabasePool) remove(element *list.Element) {
+	handle := pool.lru.Remove(element).(*pooledDatabase)
+	delete(pool.handles, handle.uid)
+	if err := handle.odb.Close(); err != nil {
+		log.Printf("DatabasePool: cannot close database of %d: %s", handle.uid, err)
+	}
+}
+
+// Delete expired objects from all user databases in the database root
+// path. Errors on individual databases are logged so that one bad file
+// does not stop the rest.
+
+func (pool *DatabasePool) DeleteExpiredObjects(now float64) (int, error) {
+	paths, err := filepath.Glob(filepath.Join(pool.databaseRootPath, "*.db"))
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, path := range paths {
+		uid, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(path), ".db"), 10, 64)
+		if err != nil {
+			continue // Not a user database
+		}
+		odb, err := pool.acquire(uid)
+		if err != nil {
+			log.Printf("DatabasePool: cannot open %s: %s", path, err)
+			continue
+		}
+		deleted, err := odb.DeleteExpiredObjects(now)
+		pool.Release(uid)
+		if err != nil {
+			log.Printf("DatabasePool: cannot delete expired objects from %s: %s", path, err)
+			continue
+		}
+		total += deleted
+	}
+	return total, nil
+}
+
+func (pool *DatabasePool) Status() BackendStatus {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	status := BackendStatus{
+		Backend: BACKEND_BOLT,
+		Healthy: !pool.closed,
+		Open:    pool.lru.Len(),
+	}
+	for element := pool.lru.Front(); element != nil; element = element.Next() {
+		if element.Value.(*pooledDatabase).refs != 0 {
+			status.InUse++
+		} else {
+			status.Idle++
+		}
+	}
+	return status
+}
+
+func (pool *DatabasePool) closeIdleDatabases() {
+	ticker := time.NewTicker(pool.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pool.mutex.Lock()
+			deadline := time.Now().Add(-pool.idleTimeout)
+			for element := pool.lru.Back(); element != nil; {
+				previous := element.Prev()
+				if handle := element.Value.(*pooledDatabase); handle.refs == 0 && handle.lastUsed.Before(deadline) {
+					pool.remove(element)
+				}
+				element = previous
+			}
+			pool.mutex.Unlock()
+		case <-pool.stop:
+			return
+		}
+	}
+}
+
+// Close all handles that are not in use. Handles that are still in use
+// are closed when they are released. No new handles can be acquired
+// after the pool has been closed.
+
+func (pool *DatabasePool) Close() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	if pool.closed {
+		return
+	}
+	pool.closed = true
+
+	close(pool.stop)
+
+	pool.evict(0)
+}
@@ -0,0 +1,840 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/lib/pq"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The Postgres backend keeps all users in one database, see the
+// migrations directory for the schema. The last modified time, the
+// usage and the object count of every collection are kept in
+// UserCollections. Writes lock the user's row in UserStorage for the
+// duration of the transaction, so like in the bolt backend the writes of
+// a user are serialized and X-If-Unmodified-Since checks and the update
+// of the last modified times cannot race with other writes.
+
+type DatabaseSession struct {
+	url   string
+	db    *sql.DB
+	quota int
+}
+
+func NewDatabaseSession(config Config) (*DatabaseSession, error) {
+	dataSourceName, err := withStatementTimeout(config.PostgresURL, config.PostgresStatementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(config.PostgresMaxOpenConns)
+	// Without a limit on open connections keep the default idle pool,
+	// because zero would mean no idle connections at all
+	if config.PostgresMaxOpenConns > 0 {
+		db.SetMaxIdleConns(config.PostgresMaxOpenConns)
+	}
+	db.SetConnMaxLifetime(config.PostgresConnMaxLifetime)
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	session := &DatabaseSession{url: config.PostgresURL, db: db, quota: config.Quota}
+	if err := session.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (ds *DatabaseSession) Close() {
+	ds.db.Close()
+}
+
+// The statement timeout is passed to the server as a run-time
+// parameter of every connection. Both URLs and key=value connection
+// strings are accepted.
+
+func withStatementTimeout(dataSourceName string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dataSourceName, nil
+	}
+	milliseconds := strconv.FormatInt(int64(timeout/time.Millisecond), 10)
+	if !strings.HasPrefix(dataSourceName, "postgres://") && !strings.HasPrefix(dataSourceName, "postgresql://") {
+		return dataSourceName + " statement_timeout=" + milliseconds, nil
+	}
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("statement_timeout", milliseconds)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Run fn in a transaction. The transaction is committed if fn returns
+// nil and rolled back otherwise.
+
+func (ds *DatabaseSession) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := ds.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Same as above but for reads that need a consistent view over more
+// than one query.
+
+func (ds *DatabaseSession) readTransaction(fn func(tx *sql.Tx) error) error {
+	tx, err := ds.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return fn(tx)
+}
+
+// Backend
+
+func (ds *DatabaseSession) Acquire(uid uint64) (Storage, error) {
+	return &PostgresStorage{ds: ds, uid: uid}, nil
+}
+
+func (ds *DatabaseSession) Release(uid uint64) {
+}
+
+func (ds *DatabaseSession) Status() BackendStatus {
+	stats := ds.db.Stats()
+	status := BackendStatus{
+		Backend: BACKEND_POSTGRES,
+		Healthy: true,
+		Open:    stats.OpenConnections,
+		InUse:   stats.InUse,
+		Idle:    stats.Idle,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// The error can contain connection details, so it is only logged
+	if err := ds.db.PingContext(ctx); err != nil {
+		log.Printf("Postgres is unhealthy: %v", err)
+		status.Healthy = false
+	}
+	return status
+}
+
+func (ds *DatabaseSession) DeleteExpiredObjects(now float64) (int, error) {
+	var deleted int64
+	err := ds.transaction(func(tx *sql.Tx) error {
+		// Lock the collections first, like writes do, so that this cannot
+		// deadlock with a write that holds a collection and wants an object
+		_, err := tx.Exec(`select 1 from UserCollections c where exists (select 1 from Objects o
+			where o.UserId = c.UserId and o.CollectionName = c.CollectionName and o.Modified + o.TTL::bigint * 100 <= $1)
+			order by c.UserId, c.CollectionName for update`, centisecondsFromTimestamp(now))
+		if err != nil {
+			return err
+		}
+		err = tx.QueryRow(`with expired as (delete from Objects where Modified + TTL::bigint * 100 <= $1 returning UserId, CollectionName, PayloadSize),
+			sizes as (select UserId, CollectionName, sum(PayloadSize) as Size, count(*) as Count from expired group by UserId, CollectionName),
+			updated as (update UserCollections c set Usage = c.Usage - s.Size, Count = c.Count - s.Count from sizes s
+				where c.UserId = s.UserId and c.CollectionName = s.CollectionName)
+			select count(*) from expired`, centisecondsFromTimestamp(now)).Scan(&deleted)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("delete from Batches where Expires <= $1", centisecondsFromTimestamp(now))
+		return err
+	})
+	return int(deleted), err
+}
+
+// Utilities
+
+// Timestamps are stored as integer centiseconds. Unlike
+// integerFromTimestamp, which the bolt index keys depend on, this rounds
+// instead of truncating, so that a time like 0.29, which is
+// 28.999999999999996 centiseconds, reads back unchanged.
+
+func centisecondsFromTimestamp(ts float64) uint64 {
+	return uint64(math.Round(ts * 100))
+}
+
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func checkUnmodifiedSince(lastModified float64, unmodifiedSince float64) error {
+	if unmodifiedSince != 0 && lastModified > unmodifiedSince {
+		return &PreconditionFailedError{LastModified: lastModified}
+	}
+	return nil
+}
+
+func scanLastModified(row *sql.Row) (float64, error) {
+	var lastModified uint64
+	if err := row.Scan(&lastModified); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return timestampFromInteger(lastModified), nil
+}
+
+// Returns the last modified time of the collection, or zero if it does
+// not exist.
+
+func getPostgresCollectionLastModified(q querier, uid uint64, collectionName string) (float64, error) {
+	return scanLastModified(q.QueryRow("select LastModified from UserCollections where UserId = $1 and CollectionName = $2", uid, collectionName))
+}
+
+// Lock the user's row in UserStorage until the transaction ends,
+// creating it if needed. Collection rows cannot be used for this
+// because they do not exist before the first write to a collection.
+
+func lockUser(q querier, uid uint64) error {
+	if _, err := q.Exec("insert into UserStorage (UserId, LastModified) values ($1, 0) on conflict (UserId) do nothing", uid); err != nil {
+		return err
+	}
+	_, err := q.Exec("select 1 from UserStorage where UserId = $1 for update", uid)
+	return err
+}
+
+// Same as above but the user's storage stays locked until the
+// transaction ends, see lockUser.
+
+func lockCollection(q querier, uid uint64, collectionName string) (float64, error) {
+	if err := lockUser(q, uid); err != nil {
+		return 0, err
+	}
+	return scanLastModified(q.QueryRow("select LastModified from UserCollections where UserId = $1 and CollectionName = $2 for update", uid, collectionName))
+}
+
+// Same as lockCollection but for all collections of the user. The last
+// modified time of the storage is the latest of the collection times
+// and the time of the last delete, which is kept in UserStorage because
+// the collection rows are gone after a delete.
+
+func lockStorage(q querier, uid uint64) (float64, error) {
+	if err := lockUser(q, uid); err != nil {
+		return 0, err
+	}
+	var lastModified uint64
+	err := q.QueryRow("select LastModified from UserStorage where UserId = $1 for update", uid).Scan(&lastModified)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	rows, err := q.Query("select LastModified from UserCollections where UserId = $1 order by CollectionName for update", uid)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var collectionLastModified uint64
+		if err := rows.Scan(&collectionLastModified); err != nil {
+			return 0, err
+		}
+		if collectionLastModified > lastModified {
+			lastModified = collectionLastModified
+		}
+	}
+	return timestampFromInteger(lastModified), rows.Err()
+}
+
+// Sets the last modified time of the collection and adds the changes in
+// payload bytes and in objects to its usage and count, like
+// updateCollectionInfo does for bolt.
+
+func updatePostgresCollection(q querier, uid uint64, collectionName string, lastModified float64, usageDelta int, countDelta int) error {
+	_, err := q.Exec(`insert into UserCollections (UserId, CollectionName, LastModified, Usage, Count) values ($1, $2, $3, $4, $5)
+		on conflict (UserId, CollectionName) do update set LastModified = excluded.LastModified,
+		Usage = UserCollections.Usage + excluded.Usage, Count = UserCollections.Count + excluded.Count`,
+		uid, collectionName, centisecondsFromTimestamp(lastModified), usageDelta, countDelta)
+	return err
+}
+
+func setPostgresStorageLastModified(q querier, uid uint64, lastModified float64) error {
+	_, err := q.Exec("insert into UserStorage (UserId, LastModified) values ($1, $2) on conflict (UserId) do update set LastModified = excluded.LastModified",
+		uid, centisecondsFromTimestamp(lastModified))
+	return err
+}
+
+func getPostgresUsage(q querier, uid uint64) (int, error) {
+	var usage int
+	err := q.QueryRow("select coalesce(sum(Usage), 0)::bigint from UserCollections where UserId = $1", uid).Scan(&usage)
+	return usage, err
+}
+
+func checkPostgresQuota(q querier, uid uint64, quota int, usageDelta int) error {
+	if quota == 0 || usageDelta <= 0 {
+		return nil
+	}
+	usage, err := getPostgresUsage(q, uid)
+	if err != nil {
+		return err
+	}
+	if usage > quota {
+		return OverQuotaErr
+	}
+	return nil
+}
+
+// Merge the object with the existing one, if any, and upsert it.
+// Returns the change in payload bytes stored and in the number of
+// objects, which is one for a new object.
+
+func putPostgresObject(q querier, uid uint64, collectionName string, object *Object, modified float64) (int, int, error) {
+	usageDelta, countDelta := len(object.Payload), 1
+
+	var existingObject Object
+	var existingModified uint64
+	err := q.QueryRow("select SortIndex, Modified, Payload, TTL from Objects where UserId = $1 and CollectionName = $2 and Id = $3 for update", uid, collectionName, object.Id).
+		Scan(&existingObject.SortIndex, &existingModified, &existingObject.Payload, &existingObject.TTL)
+	switch err {
+	case nil:
+		existingObject.Modified = timestampFromInteger(existingModified)
+		mergeObject(object, &existingObject, modified)
+		usageDelta = len(object.Payload) - len(existingObject.Payload)
+		countDelta = 0
+	case sql.ErrNoRows:
+		mergeObject(object, nil, modified)
+	default:
+		return 0, 0, err
+	}
+
+	object.Modified = modified // Always set the object's modified time
+
+	_, err = q.Exec(`insert into Objects (UserId, CollectionName, Id, SortIndex, Modified, Payload, PayloadSize, TTL) values ($1, $2, $3, $4, $5, $6, $7, $8)
+		on conflict (UserId, CollectionName, Id) do update set SortIndex = excluded.SortIndex, Modified = excluded.Modified, Payload = excluded.Payload, PayloadSize = excluded.PayloadSize, TTL = excluded.TTL`,
+		uid, collectionName, object.Id, object.SortIndex, centisecondsFromTimestamp(object.Modified), object.Payload, len(object.Payload), object.TTL)
+	return usageDelta, countDelta, err
+}
+
+// Writes all objects with the same modified time. Unlike the bolt
+// backend a failed statement aborts the whole transaction, so there are
+// no per object failures here. Writing nothing leaves the collection
+// alone.
+
+func putPostgresObjects(q querier, uid uint64, collectionName string, objects []Object, lastModified, modified float64, quota int) (PutObjectsResult, error) {
+	result := PutObjectsResult{
+		Modified: lastModified,
+		Success:  []string{},
+		Failed:   map[string]string{},
+	}
+	if len(objects) == 0 {
+		return result, nil
+	}
+	modified = nextModified(lastModified, modified)
+	result.Modified = modified
+	usageDelta, countDelta := 0, 0
+	for _, object := range uniqueObjects(objects) {
+		delta, added, err := putPostgresObject(q, uid, collectionName, &object, modified)
+		if err != nil {
+			return result, err
+		}
+		usageDelta += delta
+		countDelta += added
+		result.Success = append(result.Success, object.Id)
+	}
+	if err := updatePostgresCollection(q, uid, collectionName, modified, usageDelta, countDelta); err != nil {
+		return result, err
+	}
+	return result, checkPostgresQuota(q, uid, quota, usageDelta)
+}
+
+// Storage of a single user
+
+type PostgresStorage struct {
+	ds  *DatabaseSession
+	uid uint64
+}
+
+func (ps *PostgresStorage) GetCollectionsInfo() (map[string]CollectionInfo, error) {
+	rows, err := ps.ds.db.Query("select CollectionName, LastModified, Usage, Count from UserCollections where UserId = $1", ps.uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	infos := make(map[string]CollectionInfo)
+	for rows.Next() {
+		var collectionName string
+		var lastModified uint64
+		var usage, count int
+		if err := rows.Scan(&collectionName, &lastModified, &usage, &count); err != nil {
+			return nil, err
+		}
+		infos[collectionName] = CollectionInfo{LastModified: timestampFromInteger(lastModified), Usage: usage, Count: count}
+	}
+	return infos, rows.Err()
+}
+
+func (ps *PostgresStorage) GetCollectionLastModified(collectionName string) (float64, error) {
+	return getPostgresCollectionLastModified(ps.ds.db, ps.uid, collectionName)
+}
+
+func (ps *PostgresStorage) GetStorageLastModified() (float64, error) {
+	return scanLastModified(ps.ds.db.QueryRow(`select greatest(
+		coalesce((select LastModified from UserStorage where UserId = $1), 0),
+		coalesce((select max(LastModified) from UserCollections where UserId = $1), 0))`, ps.uid))
+}
+
+// Like in the bolt backend expired objects are counted until the reaper
+// deletes them.
+
+func (ps *PostgresStorage) GetCollectionCounts() (map[string]int, error) {
+	rows, err := ps.ds.db.Query("select CollectionName, Count from UserCollections where UserId = $1 and Count > 0", ps.uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var collectionName string
+		var count int
+		if err := rows.Scan(&collectionName, &count); err != nil {
+			return nil, err
+		}
+		counts[collectionName] = count
+	}
+	return counts, rows.Err()
+}
+
+func (ps *PostgresStorage) GetUsage() (int, int, error) {
+	usage, err := getPostgresUsage(ps.ds.db, ps.uid)
+	return usage, ps.ds.quota, err
+}
+
+func (ps *PostgresStorage) GetObject(collectionName, objectId string) (Object, error) {
+	var object Object
+	var modified uint64
+	err := ps.ds.db.QueryRow("select Id, Modified, Payload, SortIndex, TTL from Objects where UserId = $1 and CollectionName = $2 and Id = $3 and Modified + TTL::bigint * 100 > $4",
+		ps.uid, collectionName, objectId, centisecondsFromTimestamp(timestampNow())).
+		Scan(&object.Id, &modified, &object.Payload, &object.SortIndex, &object.TTL)
+	if err == sql.ErrNoRows {
+		return object, ObjectNotFoundErr
+	}
+	object.Modified = timestampFromInteger(modified)
+	return object, err
+}
+
+// Build the where and order by clauses for a collection query. Offset
+// positions use the same encoding as the bolt indexes, see index.go,
+// and are turned into keyset conditions so that pages do not shift when
+// objects are deleted between requests.
+
+func objectsQuery(uid uint64, collectionName string, options *GetObjectsOptions, now float64) (string, string, []interface{}, error) {
+	var args []interface{}
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return "$" + strconv.Itoa(len(args))
+	}
+
+	conditions := []string{
+		"UserId = " + arg(uid),
+		"CollectionName = " + arg(collectionName),
+		"Modified + TTL::bigint * 100 > " + arg(centisecondsFromTimestamp(now)),
+		"Modified > " + arg(centisecondsFromTimestamp(options.Newer)),
+	}
+	if options.Older != 0 {
+		conditions = append(conditions, "Modified < "+arg(centisecondsFromTimestamp(options.Older)))
+	}
+	if options.Ids != nil {
+		conditions = append(conditions, "Id = any("+arg(pq.Array(options.Ids))+"::text[])")
+	}
+
+	var after []byte
+	if options.Offset != nil {
+		// Objects modified after the first page was read are not part of the walk
+		conditions = append(conditions, "Modified <= "+arg(centisecondsFromTimestamp(options.Offset.Snapshot)))
+		after = options.Offset.Position
+	}
+
+	var orderBy string
+	switch {
+	case options.Sort == SORT_OLDEST || options.Sort == SORT_NEWEST || options.Sort == SORT_INDEX:
+		column, operator, direction := "Modified", ">", ""
+		if options.Sort != SORT_OLDEST {
+			operator, direction = "<", " desc"
+		}
+		if options.Sort == SORT_INDEX {
+			column = "SortIndex"
+		}
+		orderBy = column + direction + `, Id collate "C"` + direction
+		if after != nil {
+			// Postgres has no unsigned bigint, modified times never
+			// have the top bit set
+			if len(after) < 8 || (options.Sort != SORT_INDEX && binary.BigEndian.Uint64(after) > math.MaxInt64) {
+				return "", "", nil, InvalidOffsetErr
+			}
+			var value interface{} = binary.BigEndian.Uint64(after)
+			if options.Sort == SORT_INDEX {
+				value = int64(binary.BigEndian.Uint64(after) ^ (1 << 63))
+			}
+			conditions = append(conditions, fmt.Sprintf(`(%s, Id collate "C") %s (%s, %s)`, column, operator, arg(value), arg(string(after[8:]))))
+		}
+	case options.Ids != nil:
+		orderBy = "array_position(" + arg(pq.Array(options.Ids)) + "::text[], Id::text)"
+		if after != nil {
+			if len(after) != 8 || binary.BigEndian.Uint64(after) >= uint64(len(options.Ids)) {
+				return "", "", nil, InvalidOffsetErr
+			}
+			// Positions count from zero, array_position from one
+			conditions = append(conditions, orderBy+" > "+arg(binary.BigEndian.Uint64(after)+1))
+		}
+	default:
+		orderBy = `Id collate "C"`
+		if after != nil {
+			conditions = append(conditions, `Id collate "C" > `+arg(string(after)))
+		}
+	}
+
+	return strings.Join(conditions, " and "), orderBy, args, nil
+}
+
+// The offset position of an object, see objectsQuery.
+
+func objectPosition(options *GetObjectsOptions, object *Object) []byte {
+	switch {
+	case options.Sort == SORT_OLDEST || options.Sort == SORT_NEWEST:
+		position := make([]byte, 8+len(object.Id))
+		binary.BigEndian.PutUint64(position, centisecondsFromTimestamp(object.Modified))
+		copy(position[8:], object.Id)
+		return position
+	case options.Sort == SORT_INDEX:
+		return sortIndexKey(object)
+	case options.Ids != nil:
+		position := make([]byte, 8)
+		for i, objectId := range options.Ids {
+			if objectId == object.Id {
+				binary.BigEndian.PutUint64(position, uint64(i))
+				break
+			}
+		}
+		return position
+	default:
+		return []byte(object.Id)
+	}
+}
+
+func scanObject(rows *sql.Rows) (Object, error) {
+	var object Object
+	var modified uint64
+	err := rows.Scan(&object.Id, &modified, &object.Payload, &object.SortIndex, &object.TTL)
+	object.Modified = timestampFromInteger(modified)
+	return object, err
+}
+
+func (ps *PostgresStorage) StreamObjects(collectionName string, options *GetObjectsOptions, start func(info PageInfo) error, fn func(object *Object) error) error {
+	return ps.ds.readTransaction(func(tx *sql.Tx) error {
+		snapshot, err := getPostgresCollectionLastModified(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if options.Offset != nil {
+			snapshot = options.Offset.Snapshot
+		}
+
+		where, orderBy, args, err := objectsQuery(ps.uid, collectionName, options, timestampNow())
+		if err != nil {
+			return err
+		}
+
+		var info PageInfo
+		if err := tx.QueryRow("select count(*) from Objects where "+where, args...).Scan(&info.Records); err != nil {
+			return err
+		}
+
+		query := "select Id, Modified, Payload, SortIndex, TTL from Objects where " + where + " order by " + orderBy
+
+		// The next offset points at the last object of this page
+		if options.Limit > 0 && info.Records > options.Limit {
+			rows, err := tx.Query(query+fmt.Sprintf(" offset %d limit 1", options.Limit-1), args...)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+			if !rows.Next() {
+				return rows.Err()
+			}
+			object, err := scanObject(rows)
+			if err != nil {
+				return err
+			}
+			rows.Close()
+			info.NextOffset = (&Offset{Snapshot: snapshot, Sort: options.Sort, Position: objectPosition(options, &object)}).String()
+		}
+
+		if err := start(info); err != nil {
+			return err
+		}
+
+		if options.Limit > 0 {
+			query += fmt.Sprintf(" limit %d", options.Limit)
+		}
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			object, err := scanObject(rows)
+			if err != nil {
+				return err
+			}
+			if err := fn(&object); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+func (ps *PostgresStorage) PutObject(collectionName string, object Object, modified float64, unmodifiedSince float64) (Object, error) {
+	err := ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		modified := nextModified(lastModified, modified)
+		usageDelta, countDelta, err := putPostgresObject(tx, ps.uid, collectionName, &object, modified)
+		if err != nil {
+			return err
+		}
+		if err := updatePostgresCollection(tx, ps.uid, collectionName, modified, usageDelta, countDelta); err != nil {
+			return err
+		}
+		return checkPostgresQuota(tx, ps.uid, ps.ds.quota, usageDelta)
+	})
+	return object, err
+}
+
+func (ps *PostgresStorage) PutObjects(collectionName string, objects []Object, modified float64, unmodifiedSince float64) (PutObjectsResult, error) {
+	var result PutObjectsResult
+	err := ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		result, err = putPostgresObjects(tx, ps.uid, collectionName, objects, lastModified, modified, ps.ds.quota)
+		return err
+	})
+	return result, err
+}
+
+// Batches are stored as a JSON encoded list of objects, like in the
+// bolt backend.
+
+func getPostgresBatch(q querier, uid uint64, collectionName string, batchId string, now float64) (*Batch, error) {
+	id, err := strconv.ParseInt(batchId, 10, 64)
+	if err != nil {
+		return nil, BatchNotFoundErr
+	}
+	var encodedObjects []byte
+	err = q.QueryRow("select Objects from Batches where Id = $1 and UserId = $2 and CollectionName = $3 and Expires > $4 for update",
+		id, uid, collectionName, centisecondsFromTimestamp(now)).Scan(&encodedObjects)
+	if err == sql.ErrNoRows {
+		return nil, BatchNotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+	batch := &Batch{Collection: collectionName}
+	return batch, json.Unmarshal(encodedObjects, &batch.Objects)
+}
+
+func (ps *PostgresStorage) CreateBatch(collectionName string, objects []Object, modified float64, unmodifiedSince float64) (string, error) {
+	var batchId int64
+	err := ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("delete from Batches where UserId = $1 and Expires <= $2", ps.uid, centisecondsFromTimestamp(modified)); err != nil {
+			return err
+		}
+		if objects == nil {
+			objects = []Object{}
+		}
+		encodedObjects, err := json.Marshal(objects)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRow("insert into Batches (UserId, CollectionName, Expires, Objects) values ($1, $2, $3, $4) returning Id",
+			ps.uid, collectionName, centisecondsFromTimestamp(modified+BATCH_TTL), string(encodedObjects)).Scan(&batchId)
+	})
+	return strconv.FormatInt(batchId, 10), err
+}
+
+func (ps *PostgresStorage) AppendBatch(collectionName string, batchId string, objects []Object, modified float64, unmodifiedSince float64, limits BatchLimits) error {
+	return ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		batch, err := getPostgresBatch(tx, ps.uid, collectionName, batchId, modified)
+		if err != nil {
+			return err
+		}
+		if err := batch.checkLimits(objects, limits); err != nil {
+			return err
+		}
+		encodedObjects, err := json.Marshal(append(batch.Objects, objects...))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("update Batches set Objects = $1 where Id = $2", string(encodedObjects), batchId)
+		return err
+	})
+}
+
+func (ps *PostgresStorage) CommitBatch(collectionName string, batchId string, objects []Object, modified float64, unmodifiedSince float64, limits BatchLimits) (PutObjectsResult, error) {
+	var result PutObjectsResult
+	err := ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		batch, err := getPostgresBatch(tx, ps.uid, collectionName, batchId, modified)
+		if err != nil {
+			return err
+		}
+		if err := batch.checkLimits(objects, limits); err != nil {
+			return err
+		}
+		result, err = putPostgresObjects(tx, ps.uid, collectionName, append(batch.Objects, objects...), lastModified, modified, ps.ds.quota)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("delete from Batches where Id = $1", batchId)
+		return err
+	})
+	return result, err
+}
+
+func (ps *PostgresStorage) DeleteObject(collectionName, objectId string, modified float64, unmodifiedSince float64) error {
+	return ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		var payloadSize int
+		err = tx.QueryRow("delete from Objects where UserId = $1 and CollectionName = $2 and Id = $3 returning PayloadSize", ps.uid, collectionName, objectId).Scan(&payloadSize)
+		if err == sql.ErrNoRows {
+			return ObjectNotFoundErr
+		} else if err != nil {
+			return err
+		}
+		return updatePostgresCollection(tx, ps.uid, collectionName, nextModified(lastModified, modified), -payloadSize, -1)
+	})
+}
+
+func (ps *PostgresStorage) DeleteObjects(collectionName string, objectIds []string, modified float64, unmodifiedSince float64) (float64, error) {
+	err := ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		if lastModified == 0 {
+			return CollectionNotFoundErr
+		}
+		var deletedSize, deletedCount int
+		err = tx.QueryRow(`with deleted as (delete from Objects where UserId = $1 and CollectionName = $2 and Id = any($3::text[]) returning PayloadSize)
+			select coalesce(sum(PayloadSize), 0), count(*) from deleted`, ps.uid, collectionName, pq.Array(objectIds)).Scan(&deletedSize, &deletedCount)
+		if err != nil {
+			return err
+		}
+		modified = nextModified(lastModified, modified)
+		return updatePostgresCollection(tx, ps.uid, collectionName, modified, -deletedSize, -deletedCount)
+	})
+	return modified, err
+}
+
+// Returns the last modified time of the storage after the collection
+// has been deleted, which is the time of the delete.
+
+func (ps *PostgresStorage) DeleteCollection(collectionName string, modified float64, unmodifiedSince float64) (float64, error) {
+	err := ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockCollection(tx, ps.uid, collectionName)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		if lastModified == 0 {
+			return CollectionNotFoundErr
+		}
+		storageLastModified, err := lockStorage(tx, ps.uid)
+		if err != nil {
+			return err
+		}
+		for _, table := range []string{"Objects", "Batches", "UserCollections"} {
+			if _, err := tx.Exec("delete from "+table+" where UserId = $1 and CollectionName = $2", ps.uid, collectionName); err != nil {
+				return err
+			}
+		}
+		modified = nextModified(storageLastModified, modified)
+		return setPostgresStorageLastModified(tx, ps.uid, modified)
+	})
+	return modified, err
+}
+
+func (ps *PostgresStorage) DeleteStorage(modified float64, unmodifiedSince float64) error {
+	return ps.ds.transaction(func(tx *sql.Tx) error {
+		lastModified, err := lockStorage(tx, ps.uid)
+		if err != nil {
+			return err
+		}
+		if err := checkUnmodifiedSince(lastModified, unmodifiedSince); err != nil {
+			return err
+		}
+		for _, table := range []string{"Objects", "Batches", "UserCollections"} {
+			if _, err := tx.Exec("delete from "+table+" where UserId = $1", ps.uid); err != nil {
+				return err
+			}
+		}
+		return setPostgresStorageLastModified(tx, ps.uid, nextModified(lastModified, modified))
+	})
+}
@@ -0,0 +1,60 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"log"
+	"time"
+)
+
+// The reaper periodically asks the backend to physically delete objects
+// whose TTL has passed. Read paths already hide expired objects, so
+// this only reclaims space.
+
+type Reaper struct {
+	backend  Backend
+	interval time.Duration
+	stop     chan bool
+}
+
+func NewReaper(backend Backend, interval time.Duration) *Reaper {
+	return &Reaper{
+		backend:  backend,
+		interval: interval,
+		stop:     make(chan bool),
+	}
+}
+
+func (reaper *Reaper) Start() {
+	go func() {
+		ticker := time.NewTicker(reaper.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := reaper.Reap(); err != nil {
+					log.Printf("Reaper: %s", err)
+				}
+			case <-reaper.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (reaper *Reaper) Stop() {
+	reaper.stop <- true
+}
+
+func (reaper *Reaper) Reap() error {
+	deleted, err := reaper.backend.DeleteExpiredObjects(timestampNow())
+	if err != nil {
+		return err
+	}
+	if deleted != 0 {
+		log.Printf("Reaper: deleted %d expired objects", deleted)
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/gorilla/mux"
+	"github.com/st3fan/gohawk/hawk"
+	"github.com/st3fan/moz-tokenserver/token"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Calls the POST handler directly with the storage in the request
+// context, like the storage middleware would.
+
+func postObjects(t *testing.T, storage Storage, collectionName string, body string) PostObjectsResponse {
+	t.Helper()
+	c := &AppContext{config: DefaultConfig()}
+	r := httptest.NewRequest("POST", "/1.5/1/storage/"+collectionName, strings.NewReader(body))
+	r.Header.Set("Content-Type", CONTENT_TYPE_JSON)
+	r = mux.SetURLVars(r, map[string]string{"userId": "1", "collectionName": collectionName})
+	ctx := context.WithValue(r.Context(), timestampContextKey, 200.0)
+	ctx = context.WithValue(ctx, storageContextKey, storage)
+	w := httptest.NewRecorder()
+	c.PostObjectsHandler(w, r.WithContext(ctx))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST returned %d: %s", w.Code, w.Body.String())
+	}
+	var response PostObjectsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// Returns the payloads of all stored objects by id.
+
+func storedPayloads(t *testing.T, storage Storage, collectionName string) map[string]string {
+	t.Helper()
+	payloads := map[string]string{}
+	err := storage.StreamObjects(collectionName, &GetObjectsOptions{Full: true}, func(info PageInfo) error {
+		return nil
+	}, func(object *Object) error {
+		payloads[object.Id] = object.Payload
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payloads
+}
+
+func TestPostObjectsHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		existing     []Object
+		body         string
+		success      []string
+		failed       map[string]string
+		stored       map[string]string
+		lastModified float64
+	}{
+		{
+			name:         "mixed good and bad records",
+			body:         `[{"id":"a","payload":"1"},{"id":"b","payload":"2","ttl":-1},{"id":"c","payload":"3","sortindex":"x"},{"id":"d","payload":"4"}]`,
+			success:      []string{"a", "d"},
+			failed:       map[string]string{"b": InvalidTTLErr.Error(), "c": InvalidSortIndexErr.Error()},
+			stored:       map[string]string{"a": "1", "d": "4"},
+			lastModified: 200,
+		},
+		{
+			name:         "duplicate id with a bad last record",
+			existing:     []Object{{Id: "a", Payload: "old"}},
+			body:         `[{"id":"a","payload":"1"},{"id":"b","payload":"2"},{"id":"a","payload":"3","ttl":-1}]`,
+			success:      []string{"b"},
+			failed:       map[string]string{"a": InvalidTTLErr.Error()},
+			stored:       map[string]string{"a": "old", "b": "2"},
+			lastModified: 200,
+		},
+		{
+			name:         "duplicate id with a good last record",
+			existing:     []Object{{Id: "a", Payload: "old"}},
+			body:         `[{"id":"a","payload":"1","ttl":-1},{"id":"b","payload":"2"},{"id":"a","payload":"3"}]`,
+			success:      []string{"b", "a"},
+			failed:       map[string]string{},
+			stored:       map[string]string{"a": "3", "b": "2"},
+			lastModified: 200,
+		},
+		{
+			name:    "only bad records for a new collection",
+			body:    `[{"id":"a","payload":"1","ttl":-1}]`,
+			success: []string{},
+			failed:  map[string]string{"a": InvalidTTLErr.Error()},
+			stored:  map[string]string{},
+		},
+		{
+			name:         "only bad records for an existing collection",
+			existing:     []Object{{Id: "a", Payload: "old"}},
+			body:         `[{"id":"a","payload":"1","ttl":-1}]`,
+			success:      []string{},
+			failed:       map[string]string{"a": InvalidTTLErr.Error()},
+			stored:       map[string]string{"a": "old"},
+			lastModified: 100,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			storage := openBoltTestStorage(t)
+			if test.existing != nil {
+				mustPutObjects(t, storage, "tabs", test.existing, 100)
+			}
+			response := postObjects(t, storage, "tabs", test.body)
+			if !reflect.DeepEqual(response.Success, test.success) {
+				t.Errorf("success = %v, expected %v", response.Success, test.success)
+			}
+			if !reflect.DeepEqual(response.Failed, test.failed) {
+				t.Errorf("failed = %v, expected %v", response.Failed, test.failed)
+			}
+			if stored := storedPayloads(t, storage, "tabs"); !reflect.DeepEqual(stored, test.stored) {
+				t.Errorf("stored = %v, expected %v", stored, test.stored)
+			}
+			if response.Modified != test.lastModified {
+				t.Errorf("modified = %.2f, expected %.2f", response.Modified, test.lastModified)
+			}
+			infos, err := storage.GetCollectionsInfo()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, ok := infos["tabs"]; ok != (test.lastModified != 0) || info.LastModified != test.lastModified {
+				t.Errorf("info = %+v, %v, expected last modified %.2f", info, ok, test.lastModified)
+			}
+		})
+	}
+}
+
+// A stored object that cannot be decoded fails only its own record.
+
+func TestPostObjectsHandlerUndecodableExistingObject(t *testing.T) {
+	odb := openBoltTestStorage(t).(*ObjectDatabase)
+	mustPutObjects(t, odb, "tabs", []Object{{Id: "a", Payload: "old"}}, 100)
+	err := odb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte("tabs")).Put([]byte("a"), []byte("{corrupt"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := postObjects(t, odb, "tabs", `[{"id":"a","payload":"1"},{"id":"b","payload":"2"}]`)
+	if !reflect.DeepEqual(response.Success, []string{"b"}) {
+		t.Errorf("success = %v, expected [b]", response.Success)
+	}
+	if !reflect.DeepEqual(response.Failed, map[string]string{"a": "cannot replace existing object"}) {
+		t.Errorf("failed = %v", response.Failed)
+	}
+
+	object, err := odb.GetObject("tabs", "b")
+	if err != nil || object.Payload != "2" {
+		t.Errorf("GetObject(b) = %+v, %v", object, err)
+	}
+	var encodedObject []byte
+	odb.db.View(func(tx *bolt.Tx) error {
+		encodedObject = append(encodedObject, tx.Bucket([]byte("tabs")).Get([]byte("a"))...)
+		return nil
+	})
+	if string(encodedObject) != "{corrupt" {
+		t.Errorf("stored a = %q, expected it to be left alone", encodedObject)
+	}
+}
+
+// Authenticates requests with a token sent as "Authorization: Token
+// <token>" instead of a Hawk signature. The token is still checked by
+// the credentials store of the server.
+
+type tokenAuthenticator struct {
+	credentialsStore *CredentialsStore
+}
+
+func (a *tokenAuthenticator) Authenticate(w http.ResponseWriter, r *http.Request) (hawk.Credentials, bool) {
+	credentials, err := a.credentialsStore.CredentialsForKeyIdentifier(strings.TrimPrefix(r.Header.Get("Authorization"), "Token "))
+	if err != nil {
+		writeInvalidCredentials(w, "Invalid token")
+		return nil, false
+	}
+	return credentials, true
+}
+
+func newTestRouter(t *testing.T, sharedSecrets []string, publicURL string) *mux.Router {
+	config := DefaultConfig()
+	config.DatabaseRootPath = t.TempDir()
+	config.ReaperInterval = 0
+	config.SharedSecrets = sharedSecrets
+	config.PublicURL = publicURL
+	router := mux.NewRouter()
+	c, err := SetupRouter(router, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.hawkAuthenticator = &tokenAuthenticator{credentialsStore: c.credentialsStore}
+	t.Cleanup(c.Close)
+	return router
+}
+
+// Sends a request authenticated with a token for the payload.
+
+func serveTokenRequest(t *testing.T, router *mux.Router, secret string, payload token.TokenPayload, method, path string) *httptest.ResponseRecorder {
+	t.Helper()
+	tok, err := token.NewToken([]byte(secret), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(method, path, nil)
+	r.Header.Set("Authorization", "Token "+tok.Token)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func TestUserIdMustMatchToken(t *testing.T) {
+	sharedSecrets := []string{"current secret", "previous secret"}
+	router := newTestRouter(t, sharedSecrets, "")
+
+	tests := []struct {
+		name   string
+		secret string
+		method string
+		path   string
+		status int
+	}{
+		{"own storage", sharedSecrets[0], "GET", "/1.5/42/info/collections", http.StatusOK},
+		{"own storage with the previous secret", sharedSecrets[1], "GET", "/1.5/42/info/collections", http.StatusOK},
+		{"own configuration", sharedSecrets[0], "GET", "/1.5/42/info/configuration", http.StatusOK},
+		{"other user", sharedSecrets[0], "GET", "/1.5/43/info/collections", http.StatusForbidden},
+		{"other user's configuration", sharedSecrets[0], "GET", "/1.5/43/info/configuration", http.StatusForbidden},
+		{"other user's collection", sharedSecrets[0], "DELETE", "/1.5/43/storage/tabs", http.StatusForbidden},
+		{"non-numeric user", sharedSecrets[0], "GET", "/1.5/abc/info/collections", http.StatusForbidden},
+		{"unknown secret", "some other secret", "GET", "/1.5/42/info/collections", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := token.TokenPayload{Uid: 42, Node: "https://storage.example.com", Expires: time.Now().Add(time.Hour).Unix()}
+			w := serveTokenRequest(t, router, test.secret, payload, test.method, test.path)
+			if w.Code != test.status {
+				t.Errorf("%s %s returned %d, expected %d: %s", test.method, test.path, w.Code, test.status, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTokenMustBeCurrentAndForThisNode(t *testing.T) {
+	sharedSecrets := []string{"current secret"}
+	router := newTestRouter(t, sharedSecrets, "https://storage.example.com")
+
+	tests := []struct {
+		name    string
+		node    string
+		expires time.Duration
+		status  int
+	}{
+		{"this node", "https://storage.example.com", time.Hour, http.StatusOK},
+		{"this node in another case", "HTTPS://Storage.Example.COM", time.Hour, http.StatusOK},
+		{"this node with a trailing slash", "https://storage.example.com/", time.Hour, http.StatusOK},
+		{"another node", "https://other.example.com", time.Hour, http.StatusUnauthorized},
+		{"expired", "https://storage.example.com", -time.Hour, http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := token.TokenPayload{Uid: 42, Node: test.node, Expires: time.Now().Add(test.expires).Unix()}
+			w := serveTokenRequest(t, router, sharedSecrets[0], payload, "GET", "/1.5/42/info/collections")
+			if w.Code != test.status {
+				t.Fatalf("returned %d, expected %d: %s", w.Code, test.status, w.Body.String())
+			}
+			if w.Code != http.StatusUnauthorized {
+				return
+			}
+			var response invalidCredentialsResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			if response.Status != "invalid-credentials" {
+				t.Errorf("status = %q, expected invalid-credentials", response.Status)
+			}
+		})
+	}
+}
+
+// Requests that match no route still get a timestamp.
+
+func TestUnmatchedRequestsHaveTimestamp(t *testing.T) {
+	sharedSecrets := []string{"current secret"}
+	router := newTestRouter(t, sharedSecrets, "")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"unknown path", "GET", "/nothing", http.StatusNotFound},
+		{"unknown user path", "GET", "/1.5/42/nothing", http.StatusNotFound},
+		{"unknown storage path", "GET", "/1.5/42/info/nothing", http.StatusNotFound},
+		{"invalid collection name", "GET", "/1.5/42/storage/not!valid", http.StatusNotFound},
+		{"unsupported method", "PATCH", "/1.5/42/storage/tabs", http.StatusMethodNotAllowed},
+		{"unsupported method for the configuration", "POST", "/1.5/42/info/configuration", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			payload := token.TokenPayload{Uid: 42, Node: "https://storage.example.com", Expires: time.Now().Add(time.Hour).Unix()}
+			w := serveTokenRequest(t, router, sharedSecrets[0], payload, test.method, test.path)
+			if w.Code != test.status {
+				t.Errorf("%s %s returned %d, expected %d", test.method, test.path, w.Code, test.status)
+			}
+			if w.Header().Get("X-Weave-Timestamp") == "" {
+				t.Errorf("%s %s has no X-Weave-Timestamp", test.method, test.path)
+			}
+		})
+	}
+}
+
+// The public status only tells whether the backend is healthy, the
+// details are in the metrics.
+
+func TestStatusAndMetrics(t *testing.T) {
+	config := DefaultConfig()
+	config.DatabaseRootPath = t.TempDir()
+	config.ReaperInterval = 0
+	config.SharedSecrets = []string{"current secret", "previous secret"}
+	c, err := SetupRouter(mux.NewRouter(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	w := httptest.NewRecorder()
+	c.StatusHandler(w, httptest.NewRequest("GET", "/status", nil))
+	if w.Code != http.StatusOK || w.Body.String() != `{"healthy":true}` {
+		t.Errorf("status returned %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	c.MetricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	var metrics MetricsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || metrics.Backend != BACKEND_BOLT || !metrics.Healthy || len(metrics.SharedSecrets) != 2 {
+		t.Errorf("metrics returned %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,88 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	BACKEND_BOLT     = "bolt"
+	BACKEND_POSTGRES = "postgres"
+)
+
+var NotSupportedErr = errors.New("Not supported by this backend")
+
+// The storage of a single user. The handlers only talk to this
+// interface. The bolt backed ObjectDatabase and the Postgres backed
+// PostgresStorage implement it.
+
+type Storage interface {
+	GetCollectionsInfo() (map[string]CollectionInfo, error)
+	GetCollectionLastModified(collectionName string) (float64, error)
+	GetStorageLastModified() (float64, error)
+	GetCollectionCounts() (map[string]int, error)
+	GetUsage() (int, int, error)
+
+	GetObject(collectionName, objectId string) (Object, error)
+	StreamObjects(collectionName string, options *GetObjectsOptions, start func(info PageInfo) error, fn func(object *Object) error) error
+
+	PutObject(collectionName string, object Object, modified float64, unmodifiedSince float64) (Object, error)
+	PutObjects(collectionName string, objects []Object, modified float64, unmodifiedSince float64) (PutObjectsResult, error)
+
+	CreateBatch(collectionName string, objects []Object, modified float64, unmodifiedSince float64) (string, error)
+	AppendBatch(collectionName string, batchId string, objects []Object, modified float64, unmodifiedSince float64, limits BatchLimits) error
+	CommitBatch(collectionName string, batchId string, objects []Object, modified float64, unmodifiedSince float64, limits BatchLimits) (PutObjectsResult, error)
+
+	DeleteObject(collectionName, objectId string, modified float64, unmodifiedSince float64) error
+	DeleteObjects(collectionName string, objectIds []string, modified float64, unmodifiedSince float64) (float64, error)
+	DeleteCollection(collectionName string, modified float64, unmodifiedSince float64) (float64, error)
+	DeleteStorage(modified float64, unmodifiedSince float64) error
+}
+
+// A backend hands out the storage of individual users. Every Acquire
+// must be matched by a Release once the request is done with it.
+
+type Backend interface {
+	Acquire(uid uint64) (Storage, error)
+	Release(uid uint64)
+	DeleteExpiredObjects(now float64) (int, error)
+	Status() BackendStatus
+	Close()
+}
+
+// The health of a backend as reported by the status endpoint. Open
+// counts open connections or database files, depending on the backend.
+
+type BackendStatus struct {
+	Backend string `json:"backend"`
+	Healthy bool   `json:"healthy"`
+	Open    int    `json:"open"`
+	InUse   int    `json:"in_use"`
+	Idle    int    `json:"idle"`
+}
+
+var _ Storage = (*ObjectDatabase)(nil)
+var _ Storage = (*PostgresStorage)(nil)
+var _ Backend = (*DatabasePool)(nil)
+var _ Backend = (*DatabaseSession)(nil)
+
+// Create the backend selected in the configuration.
+
+func NewBackend(config Config) (Backend, error) {
+	switch config.Backend {
+	case BACKEND_BOLT:
+		return NewDatabasePool(config.DatabaseRootPath, config.Quota, config.MaxOpenDatabases, config.DatabaseIdleTimeout), nil
+	case BACKEND_POSTGRES:
+		session, err := NewDatabaseSession(config)
+		if err != nil {
+			return nil, err
+		}
+		return session, nil
+	default:
+		return nil, fmt.Errorf("Unknown backend: %s", config.Backend)
+	}
+}
@@ -0,0 +1,770 @@
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package storageserver
+
+import (
+	"github.com/boltdb/bolt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Conformance tests for the Storage interface. Every test runs against
+// the bolt backend and, when STORAGESERVER_TEST_POSTGRES_URL is set to
+// the URL of a scratch database, against the Postgres backend.
+
+const TEST_POSTGRES_URL_ENV = "STORAGESERVER_TEST_POSTGRES_URL"
+
+var testBatchLimits = BatchLimits{MaxTotalRecords: 4, MaxTotalBytes: 1024}
+
+var storageTests = []struct {
+	name string
+	test func(t *testing.T, storage Storage)
+}{
+	{"Info", testStorageInfo},
+	{"Counts", testStorageCounts},
+	{"PutAndMerge", testStoragePutAndMerge},
+	{"ModifiedOnlyMovesForward", testStorageModifiedOnlyMovesForward},
+	{"TTL", testStorageTTL},
+	{"Sort", testStorageSort},
+	{"Filters", testStorageFilters},
+	{"Offsets", testStorageOffsets},
+	{"Batches", testStorageBatches},
+	{"Preconditions", testStoragePreconditions},
+	{"DeleteObjects", testStorageDeleteObjects},
+	{"DeleteCollection", testStorageDeleteCollection},
+	{"DeleteStorage", testStorageDeleteStorage},
+}
+
+func TestStorage(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(t *testing.T) Storage
+	}{
+		{BACKEND_BOLT, openBoltTestStorage},
+	}
+	if os.Getenv(TEST_POSTGRES_URL_ENV) != "" {
+		backends = append(backends, struct {
+			name string
+			open func(t *testing.T) Storage
+		}{BACKEND_POSTGRES, openPostgresTestStorage})
+	}
+
+	for _, backend := range backends {
+		for _, storageTest := range storageTests {
+			t.Run(backend.name+"/"+storageTest.name, func(t *testing.T) {
+				storageTest.test(t, backend.open(t))
+			})
+		}
+	}
+}
+
+// The reaper corrects the usage and count of the collections that it
+// deletes expired objects from.
+
+func TestBoltDeleteExpiredObjects(t *testing.T) {
+	odb := openBoltTestStorage(t).(*ObjectDatabase)
+	mustPutObjects(t, odb, "bookmarks", []Object{{Id: "a", Payload: "xy", TTL: 10}, {Id: "b", Payload: "x"}}, 100)
+
+	deleted, err := odb.DeleteExpiredObjects(200)
+	if err != nil || deleted != 1 {
+		t.Fatalf("DeleteExpiredObjects() = %d, %v, expected 1", deleted, err)
+	}
+	counts, err := odb.GetCollectionCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"bookmarks": 1}) {
+		t.Errorf("GetCollectionCounts() = %v after the reaper ran", counts)
+	}
+	expectUsage(t, odb, 1)
+}
+
+// Collection info written before counts were kept is counted when the
+// database is opened.
+
+func TestBoltCountsOldCollectionInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.db")
+	odb, err := OpenObjectDatabase(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPutObjects(t, odb, "tabs", []Object{{Id: "a", Payload: "x"}, {Id: "b", Payload: "x"}}, 100)
+	err = odb.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(COLLECTIONS_BUCKET)).Put([]byte("tabs"), []byte(`{"LastModified":100,"Usage":2}`))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	odb.Close()
+
+	odb, err = OpenObjectDatabase(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer odb.Close()
+	counts, err := odb.GetCollectionCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(counts, map[string]int{"tabs": 2}) {
+		t.Errorf("GetCollectionCounts() = %v, expected map[tabs:2]", counts)
+	}
+}
+
+// Collections written before indexes existed are indexed when the
+// database is opened, so that they can be sorted right away.
+
+func TestBoltIndexesOldCollections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "1.db")
+	odb, err := OpenObjectDatabase(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustPutObjects(t, odb, "tabs", []Object{{Id: "a", Payload: "x", SortIndex: 1}}, 100)
+	mustPutObjects(t, odb, "tabs", []Object{{Id: "b", Payload: "x", SortIndex: 3}}, 110)
+	mustPutObjects(t, odb, "tabs", []Object{{Id: "c", Payload: "x", SortIndex: 2}}, 120)
+	err = odb.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(modifiedIndexBucketName("tabs")); err != nil {
+			return err
+		}
+		return tx.DeleteBucket(sortIndexBucketName("tabs"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	odb.Close()
+
+	odb, err = OpenObjectDatabase(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer odb.Close()
+	if objectIds, _ := streamObjectIds(t, odb, "tabs", GetObjectsOptions{Sort: SORT_NEWEST}); !reflect.DeepEqual(objectIds, []string{"c", "b", "a"}) {
+		t.Errorf("sort=newest returned %v", objectIds)
+	}
+	if objectIds, _ := streamObjectIds(t, odb, "tabs", GetObjectsOptions{Sort: SORT_INDEX}); !reflect.DeepEqual(objectIds, []string{"b", "c", "a"}) {
+		t.Errorf("sort=index returned %v", objectIds)
+	}
+}
+
+func openBoltTestStorage(t *testing.T) Storage {
+	odb, err := OpenObjectDatabase(filepath.Join(t.TempDir(), "1.db"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { odb.Close() })
+	return odb
+}
+
+// Every test gets a random user so that tests do not see each other's
+// data. The user's data is deleted when the test is done.
+
+func openPostgresTestStorage(t *testing.T) Storage {
+	config := DefaultConfig()
+	config.PostgresURL = os.Getenv(TEST_POSTGRES_URL_ENV)
+	session, err := NewDatabaseSession(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := session.Acquire(uint64(rand.Int63()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.DeleteStorage(timestampNow(), 0); err != nil {
+			t.Error(err)
+		}
+		session.Close()
+	})
+	return storage
+}
+
+// Helpers
+
+func mustPutObjects(t *testing.T, storage Storage, collectionName string, objects []Object, modified float64) PutObjectsResult {
+	t.Helper()
+	result, err := storage.PutObjects(collectionName, objects, modified, 0)
+	if err != nil {
+		t.Fatalf("PutObjects(%s): %s", collectionName, err)
+	}
+	return result
+}
+
+func streamObjectIds(t *testing.T, storage Storage, collectionName string, options GetObjectsOptions) ([]string, PageInfo) {
+	t.Helper()
+	objectIds := []string{}
+	var info PageInfo
+	err := storage.StreamObjects(collectionName, &options, func(pageInfo PageInfo) error {
+		info = pageInfo
+		return nil
+	}, func(object *Object) error {
+		objectIds = append(objectIds, object.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamObjects(%s): %s", collectionName, err)
+	}
+	return objectIds, info
+}
+
+func expectObject(t *testing.T, storage Storage, collectionName string, expected Object) {
+	t.Helper()
+	object, err := storage.GetObject(collectionName, expected.Id)
+	if err != nil {
+		t.Fatalf("GetObject(%s, %s): %s", collectionName, expected.Id, err)
+	}
+	if object != expected {
+		t.Errorf("GetObject(%s, %s) = %+v, expected %+v", collectionName, expected.Id, object, expected)
+	}
+}
+
+func expectObjectNotFound(t *testing.T, storage Storage, collectionName, objectId string) {
+	t.Helper()
+	if _, err := storage.GetObject(collectionName, objectId); err != ObjectNotFoundErr {
+		t.Errorf("GetObject(%s, %s): expected ObjectNotFoundErr, got %v", collectionName, objectId, err)
+	}
+}
+
+func expectLastModified(t *testing.T, storage Storage, collectionName string, expected float64) {
+	t.Helper()
+	lastModified, err := storage.GetCollectionLastModified(collectionName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastModified != expected {
+		t.Errorf("GetCollectionLastModified(%s) = %.2f, expected %.2f", collectionName, lastModified, expected)
+	}
+}
+
+func expectStorageLastModified(t *testing.T, storage Storage, expected float64) {
+	t.Helper()
+	lastModified, err := storage.GetStorageLastModified()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastModified != expected {
+		t.Errorf("GetStorageLastModified() = %.2f, expected %.2f", lastModified, expected)
+	}
+}
+
+func expectUsage(t *testing.T, storage Storage, expected int) {
+	t.Helper()
+	usage, _, err := storage.GetUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage != expected {
+		t.Errorf("GetUsage() = %d, expected %d", usage, expected)
+	}
+}
+
+func expectPreconditionFailed(t *testing.T, err error, lastModified float64) {
+	t.Helper()
+	preconditionFailedError, ok := err.(*PreconditionFailedError)
+	if !ok {
+		t.Fatalf("expected a PreconditionFailedError, got %v", err)
+	}
+	if preconditionFailedError.LastModified != lastModified {
+		t.Errorf("PreconditionFailedError.LastModified = %.2f, expected %.2f", preconditionFailedError.LastModified, lastModified)
+	}
+}
+
+// Tests
+
+func testStorageInfo(t *testing.T, storage Storage) {
+	infos, err := storage.GetCollectionsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("GetCollectionsInfo() = %v on an empty storage", infos)
+	}
+	expectStorageLastModified(t, storage, 0)
+	expectUsage(t, storage, 0)
+
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "abc"}, {Id: "b", Payload: "d"}}, 100)
+	mustPutObjects(t, storage, "forms", []Object{{Id: "c", Payload: "ef"}}, 200)
+
+	infos, err = storage.GetCollectionsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]CollectionInfo{
+		"tabs":  {LastModified: 100, Usage: 4, Count: 2},
+		"forms": {LastModified: 200, Usage: 2, Count: 1},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Errorf("GetCollectionsInfo() = %v, expected %v", infos, expected)
+	}
+	expectLastModified(t, storage, "tabs", 100)
+	expectLastModified(t, storage, "forms", 200)
+	expectLastModified(t, storage, "missing", 0)
+	expectStorageLastModified(t, storage, 200)
+	expectUsage(t, storage, 6)
+}
+
+func testStorageCounts(t *testing.T, storage Storage) {
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "x"}, {Id: "b", Payload: "x"}}, 100)
+	mustPutObjects(t, storage, "forms", []Object{{Id: "a", Payload: "x"}}, 110)
+	mustPutObjects(t, storage, "history", []Object{{Id: "a", Payload: "x"}}, 120)
+	if err := storage.DeleteObject("history", "a", 130, 0); err != nil {
+		t.Fatal(err)
+	}
+	mustPutObjects(t, storage, "bookmarks", []Object{{Id: "a", Payload: "x", TTL: 10}, {Id: "b", Payload: "x"}}, 140)
+
+	counts, err := storage.GetCollectionCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Collections without objects are left out, and expired objects are
+	// counted until the reaper deletes them
+	expected := map[string]int{"tabs": 2, "forms": 1, "bookmarks": 2}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("GetCollectionCounts() = %v, expected %v", counts, expected)
+	}
+}
+
+func testStoragePutAndMerge(t *testing.T, storage Storage) {
+	object, err := storage.PutObject("tabs", Object{Id: "a", Payload: "one", SortIndex: 5}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Object{Id: "a", Modified: 100, Payload: "one", SortIndex: 5, TTL: DEFAULT_TTL}
+	if object != expected {
+		t.Errorf("PutObject() = %+v, expected %+v", object, expected)
+	}
+	expectObject(t, storage, "tabs", expected)
+
+	// Fields that are left out keep their current value
+	object, err = storage.PutObject("tabs", Object{Id: "a", SortIndex: 7}, 110, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = Object{Id: "a", Modified: 110, Payload: "one", SortIndex: 7, TTL: DEFAULT_TTL}
+	if object != expected {
+		t.Errorf("PutObject() = %+v, expected %+v", object, expected)
+	}
+	expectObject(t, storage, "tabs", expected)
+
+	result := mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "two"}, {Id: "b", Payload: "x"}, {Id: "b", Payload: "y"}}, 120)
+	if result.Modified != 120 || !reflect.DeepEqual(result.Success, []string{"a", "b"}) || len(result.Failed) != 0 {
+		t.Errorf("PutObjects() = %+v", result)
+	}
+	expectObject(t, storage, "tabs", Object{Id: "a", Modified: 120, Payload: "two", SortIndex: 7, TTL: DEFAULT_TTL})
+	// The last object with an id wins
+	expectObject(t, storage, "tabs", Object{Id: "b", Modified: 120, Payload: "y", TTL: DEFAULT_TTL})
+
+	expectLastModified(t, storage, "tabs", 120)
+	expectUsage(t, storage, 4)
+	expectObjectNotFound(t, storage, "tabs", "missing")
+	expectObjectNotFound(t, storage, "missing", "a")
+}
+
+func testStorageModifiedOnlyMovesForward(t *testing.T, storage Storage) {
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "x"}}, 200)
+
+	// A write that started before the last one committed is moved after it
+	object, err := storage.PutObject("tabs", Object{Id: "b", Payload: "x"}, 150, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Modified != 200.01 {
+		t.Errorf("PutObject() modified = %.2f, expected 200.01", object.Modified)
+	}
+	result := mustPutObjects(t, storage, "tabs", []Object{{Id: "c", Payload: "x"}}, 200.01)
+	if result.Modified != 200.02 {
+		t.Errorf("PutObjects() modified = %.2f, expected 200.02", result.Modified)
+	}
+	modified, err := storage.DeleteObjects("tabs", []string{"c"}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified != 200.03 {
+		t.Errorf("DeleteObjects() = %.2f, expected 200.03", modified)
+	}
+	expectLastModified(t, storage, "tabs", 200.03)
+
+	objectIds, _ := streamObjectIds(t, storage, "tabs", GetObjectsOptions{Newer: 200})
+	if !reflect.DeepEqual(objectIds, []string{"b"}) {
+		t.Errorf("objects newer than 200 = %v, expected [b]", objectIds)
+	}
+}
+
+func testStorageTTL(t *testing.T, storage Storage) {
+	now := timestampNow()
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "expired", Payload: "x", TTL: 10}}, now-100)
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "live", Payload: "x", TTL: 3600}}, now)
+
+	expectObjectNotFound(t, storage, "tabs", "expired")
+	expectObject(t, storage, "tabs", Object{Id: "live", Modified: now, Payload: "x", TTL: 3600})
+
+	objectIds, info := streamObjectIds(t, storage, "tabs", GetObjectsOptions{})
+	if !reflect.DeepEqual(objectIds, []string{"live"}) || info.Records != 1 {
+		t.Errorf("objects = %v with %d records, expected [live]", objectIds, info.Records)
+	}
+
+	// An expired object is replaced as if it did not exist
+	object, err := storage.PutObject("tabs", Object{Id: "expired", SortIndex: 1}, now+1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.Payload != "" || object.TTL != DEFAULT_TTL {
+		t.Errorf("PutObject() = %+v, expected an empty payload and the default TTL", object)
+	}
+
+	// Updating a live object without a TTL keeps its expiry time
+	object, err = storage.PutObject("tabs", Object{Id: "live", Payload: "y"}, now+2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.TTL != 3598 {
+		t.Errorf("PutObject() TTL = %d, expected 3598", object.TTL)
+	}
+
+	mustPutObjects(t, storage, "forms", []Object{{Id: "short", Payload: "x", TTL: 10}}, now-9)
+	mustPutObjects(t, storage, "forms", []Object{{Id: "short", Payload: "y"}}, now)
+	expectObject(t, storage, "forms", Object{Id: "short", Modified: now, Payload: "y", TTL: 1})
+
+	// Objects without a TTL keep not expiring
+	object, err = storage.PutObject("tabs", Object{Id: "expired", Payload: "z"}, now+3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if object.TTL != DEFAULT_TTL {
+		t.Errorf("PutObject() TTL = %d, expected the default TTL", object.TTL)
+	}
+}
+
+// Objects a to e, written one by one, with sortindexes that do not
+// follow the write order.
+
+func putSortTestObjects(t *testing.T, storage Storage) {
+	for i, sortIndex := range []int{3, 1, 5, 2, 4} {
+		objectId := string(rune('a' + i))
+		mustPutObjects(t, storage, "tabs", []Object{{Id: objectId, Payload: "x", SortIndex: sortIndex}}, float64(100+10*i))
+	}
+}
+
+func testStorageSort(t *testing.T, storage Storage) {
+	putSortTestObjects(t, storage)
+
+	tests := []struct {
+		sort     string
+		expected []string
+	}{
+		{"", []string{"a", "b", "c", "d", "e"}},
+		{SORT_NEWEST, []string{"e", "d", "c", "b", "a"}},
+		{SORT_OLDEST, []string{"a", "b", "c", "d", "e"}},
+		{SORT_INDEX, []string{"c", "e", "a", "d", "b"}},
+	}
+	for _, test := range tests {
+		objectIds, info := streamObjectIds(t, storage, "tabs", GetObjectsOptions{Sort: test.sort})
+		if !reflect.DeepEqual(objectIds, test.expected) {
+			t.Errorf("sort=%s: %v, expected %v", test.sort, objectIds, test.expected)
+		}
+		if info.Records != 5 || info.NextOffset != "" {
+			t.Errorf("sort=%s: page info %+v", test.sort, info)
+		}
+	}
+}
+
+func testStorageFilters(t *testing.T, storage Storage) {
+	putSortTestObjects(t, storage)
+
+	tests := []struct {
+		name     string
+		options  GetObjectsOptions
+		expected []string
+	}{
+		{"newer", GetObjectsOptions{Newer: 110}, []string{"c", "d", "e"}},
+		{"older", GetObjectsOptions{Older: 130}, []string{"a", "b", "c"}},
+		{"newer and older", GetObjectsOptions{Newer: 100, Older: 140, Sort: SORT_NEWEST}, []string{"d", "c", "b"}},
+		{"ids", GetObjectsOptions{Ids: []string{"d", "a", "missing"}}, []string{"d", "a"}},
+		{"ids sorted", GetObjectsOptions{Ids: []string{"d", "a", "e"}, Sort: SORT_OLDEST}, []string{"a", "d", "e"}},
+		{"missing collection", GetObjectsOptions{}, []string{}},
+	}
+	for _, test := range tests {
+		collectionName := "tabs"
+		if test.name == "missing collection" {
+			collectionName = "missing"
+		}
+		objectIds, info := streamObjectIds(t, storage, collectionName, test.options)
+		if !reflect.DeepEqual(objectIds, test.expected) || info.Records != len(test.expected) {
+			t.Errorf("%s: %v with %d records, expected %v", test.name, objectIds, info.Records, test.expected)
+		}
+	}
+}
+
+func testStorageOffsets(t *testing.T, storage Storage) {
+	putSortTestObjects(t, storage)
+
+	for _, sort := range []string{"", SORT_NEWEST, SORT_OLDEST, SORT_INDEX} {
+		all, _ := streamObjectIds(t, storage, "tabs", GetObjectsOptions{Sort: sort})
+
+		var walked []string
+		options := GetObjectsOptions{Sort: sort, Limit: 2}
+		for pages := 0; ; pages++ {
+			if pages == 10 {
+				t.Fatalf("sort=%s: too many pages", sort)
+			}
+			objectIds, info := streamObjectIds(t, storage, "tabs", options)
+			walked = append(walked, objectIds...)
+			if info.NextOffset == "" {
+				break
+			}
+			if pages == 0 {
+				// Objects written during the walk are not part of it
+				mustPutObjects(t, storage, "tabs", []Object{{Id: "f" + sort, Payload: "x", SortIndex: 6}}, 0)
+			}
+			offset, err := ParseOffset(info.NextOffset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			options.Offset = offset
+		}
+		if !reflect.DeepEqual(walked, all) {
+			t.Errorf("sort=%s: walked %v, expected %v", sort, walked, all)
+		}
+	}
+
+	// Offsets come from clients, positions that cannot be valid are refused
+	invalidOffsets := []struct {
+		name    string
+		options GetObjectsOptions
+	}{
+		{"ids position with the top bit set", GetObjectsOptions{Ids: []string{"a"}, Offset: &Offset{Position: []byte{0x80, 0, 0, 0, 0, 0, 0, 0}}}},
+		{"ids position past the ids", GetObjectsOptions{Ids: []string{"a", "b"}, Offset: &Offset{Position: []byte{0, 0, 0, 0, 0, 0, 0, 2}}}},
+		{"ids position of the wrong size", GetObjectsOptions{Ids: []string{"a"}, Offset: &Offset{Position: []byte{0}}}},
+		{"modified position with the top bit set", GetObjectsOptions{Sort: SORT_NEWEST, Offset: &Offset{Sort: SORT_NEWEST, Position: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'a'}}}},
+	}
+	for _, test := range invalidOffsets {
+		options := test.options
+		err := storage.StreamObjects("tabs", &options, func(info PageInfo) error { return nil }, func(object *Object) error { return nil })
+		if err != InvalidOffsetErr {
+			t.Errorf("%s: expected InvalidOffsetErr, got %v", test.name, err)
+		}
+	}
+}
+
+func testStorageBatches(t *testing.T, storage Storage) {
+	batchId, err := storage.CreateBatch("tabs", []Object{{Id: "a", Payload: "1"}}, 100, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.AppendBatch("tabs", batchId, []Object{{Id: "b", Payload: "2"}}, 101, 0, testBatchLimits); err != nil {
+		t.Fatal(err)
+	}
+
+	// Staged objects are not visible until the batch is committed
+	expectObjectNotFound(t, storage, "tabs", "a")
+	expectLastModified(t, storage, "tabs", 0)
+
+	if err := storage.AppendBatch("tabs", batchId, []Object{{Id: "c"}, {Id: "d"}, {Id: "e"}}, 102, 0, testBatchLimits); err != BatchTooLargeErr {
+		t.Errorf("AppendBatch() over the limits: expected BatchTooLargeErr, got %v", err)
+	}
+	if err := storage.AppendBatch("forms", batchId, nil, 102, 0, testBatchLimits); err != BatchNotFoundErr {
+		t.Errorf("AppendBatch() to another collection: expected BatchNotFoundErr, got %v", err)
+	}
+	if err := storage.AppendBatch("tabs", "12345678", nil, 102, 0, testBatchLimits); err != BatchNotFoundErr {
+		t.Errorf("AppendBatch() to a missing batch: expected BatchNotFoundErr, got %v", err)
+	}
+	if err := storage.AppendBatch("tabs", "invalid", nil, 102, 0, testBatchLimits); err != BatchNotFoundErr {
+		t.Errorf("AppendBatch() to an invalid batch id: expected BatchNotFoundErr, got %v", err)
+	}
+
+	result, err := storage.CommitBatch("tabs", batchId, []Object{{Id: "c", Payload: "3"}}, 103, 0, testBatchLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Modified != 103 || !reflect.DeepEqual(result.Success, []string{"a", "b", "c"}) || len(result.Failed) != 0 {
+		t.Errorf("CommitBatch() = %+v", result)
+	}
+	expectObject(t, storage, "tabs", Object{Id: "b", Modified: 103, Payload: "2", TTL: DEFAULT_TTL})
+	expectLastModified(t, storage, "tabs", 103)
+
+	if _, err := storage.CommitBatch("tabs", batchId, nil, 104, 0, testBatchLimits); err != BatchNotFoundErr {
+		t.Errorf("CommitBatch() of a committed batch: expected BatchNotFoundErr, got %v", err)
+	}
+
+	// Committing an empty batch writes nothing, but the batch is gone
+	batchId, err = storage.CreateBatch("tabs", nil, 150, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err = storage.CommitBatch("tabs", batchId, nil, 151, 0, testBatchLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Modified != 103 || len(result.Success) != 0 || len(result.Failed) != 0 {
+		t.Errorf("CommitBatch() of an empty batch = %+v", result)
+	}
+	expectLastModified(t, storage, "tabs", 103)
+	if _, err := storage.CommitBatch("tabs", batchId, nil, 152, 0, testBatchLimits); err != BatchNotFoundErr {
+		t.Errorf("CommitBatch() of a committed empty batch: expected BatchNotFoundErr, got %v", err)
+	}
+
+	// Batches expire
+	batchId, err = storage.CreateBatch("tabs", nil, 200, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.CommitBatch("tabs", batchId, nil, 200+BATCH_TTL, 0, testBatchLimits); err != BatchNotFoundErr {
+		t.Errorf("CommitBatch() of an expired batch: expected BatchNotFoundErr, got %v", err)
+	}
+}
+
+func testStoragePreconditions(t *testing.T, storage Storage) {
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "x"}, {Id: "b", Payload: "x"}}, 100)
+
+	_, err := storage.PutObject("tabs", Object{Id: "a", Payload: "y"}, 110, 90)
+	expectPreconditionFailed(t, err, 100)
+	_, err = storage.PutObjects("tabs", []Object{{Id: "a", Payload: "y"}}, 110, 90)
+	expectPreconditionFailed(t, err, 100)
+	_, err = storage.CreateBatch("tabs", nil, 110, 90)
+	expectPreconditionFailed(t, err, 100)
+	err = storage.DeleteObject("tabs", "a", 110, 90)
+	expectPreconditionFailed(t, err, 100)
+	_, err = storage.DeleteObjects("tabs", []string{"a"}, 110, 90)
+	expectPreconditionFailed(t, err, 100)
+	_, err = storage.DeleteCollection("tabs", 110, 90)
+	expectPreconditionFailed(t, err, 100)
+	err = storage.DeleteStorage(110, 90)
+	expectPreconditionFailed(t, err, 100)
+
+	// Nothing was changed by the failed writes
+	expectObject(t, storage, "tabs", Object{Id: "a", Modified: 100, Payload: "x", TTL: DEFAULT_TTL})
+	expectLastModified(t, storage, "tabs", 100)
+
+	// Writes pass when the collection has not been modified since
+	if _, err := storage.PutObject("tabs", Object{Id: "a", Payload: "y"}, 110, 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.PutObject("forms", Object{Id: "a", Payload: "y"}, 120, 50); err != nil {
+		t.Fatalf("PutObject() to a new collection: %s", err)
+	}
+	if err := storage.DeleteObject("tabs", "b", 130, 110); err != nil {
+		t.Fatal(err)
+	}
+	expectLastModified(t, storage, "tabs", 130)
+}
+
+func testStorageDeleteObjects(t *testing.T, storage Storage) {
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "xx"}, {Id: "b", Payload: "x"}, {Id: "c", Payload: "x"}}, 100)
+
+	if err := storage.DeleteObject("tabs", "a", 110, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectObjectNotFound(t, storage, "tabs", "a")
+	expectLastModified(t, storage, "tabs", 110)
+	expectUsage(t, storage, 2)
+
+	if err := storage.DeleteObject("tabs", "a", 120, 0); err != ObjectNotFoundErr {
+		t.Errorf("DeleteObject() of a missing object: expected ObjectNotFoundErr, got %v", err)
+	}
+	if err := storage.DeleteObject("missing", "a", 120, 0); err != ObjectNotFoundErr {
+		t.Errorf("DeleteObject() in a missing collection: expected ObjectNotFoundErr, got %v", err)
+	}
+
+	// Ids that do not exist are ignored
+	modified, err := storage.DeleteObjects("tabs", []string{"b", "missing"}, 130, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified != 130 {
+		t.Errorf("DeleteObjects() = %.2f, expected 130", modified)
+	}
+	objectIds, _ := streamObjectIds(t, storage, "tabs", GetObjectsOptions{})
+	if !reflect.DeepEqual(objectIds, []string{"c"}) {
+		t.Errorf("objects after deletes = %v, expected [c]", objectIds)
+	}
+	expectLastModified(t, storage, "tabs", 130)
+	expectUsage(t, storage, 1)
+
+	if _, err := storage.DeleteObjects("missing", []string{"a"}, 140, 0); err != CollectionNotFoundErr {
+		t.Errorf("DeleteObjects() in a missing collection: expected CollectionNotFoundErr, got %v", err)
+	}
+}
+
+func testStorageDeleteCollection(t *testing.T, storage Storage) {
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "xx"}}, 100)
+	mustPutObjects(t, storage, "forms", []Object{{Id: "a", Payload: "x"}}, 110)
+
+	modified, err := storage.DeleteCollection("tabs", 120, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified != 120 {
+		t.Errorf("DeleteCollection() = %.2f, expected 120", modified)
+	}
+	expectObjectNotFound(t, storage, "tabs", "a")
+	expectLastModified(t, storage, "tabs", 0)
+	expectStorageLastModified(t, storage, 120)
+	expectUsage(t, storage, 1)
+
+	infos, err := storage.GetCollectionsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := infos["tabs"]; ok || len(infos) != 1 {
+		t.Errorf("GetCollectionsInfo() after delete = %v", infos)
+	}
+
+	if _, err := storage.DeleteCollection("tabs", 130, 0); err != CollectionNotFoundErr {
+		t.Errorf("DeleteCollection() of a missing collection: expected CollectionNotFoundErr, got %v", err)
+	}
+
+	// The storage last modified time does not move backwards
+	modified, err = storage.DeleteCollection("forms", 115, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modified != 120.01 {
+		t.Errorf("DeleteCollection() = %.2f, expected 120.01", modified)
+	}
+	expectStorageLastModified(t, storage, 120.01)
+
+	// A collection can be created again after it was deleted
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "b", Payload: "x"}}, 140)
+	expectLastModified(t, storage, "tabs", 140)
+}
+
+func testStorageDeleteStorage(t *testing.T, storage Storage) {
+	mustPutObjects(t, storage, "tabs", []Object{{Id: "a", Payload: "xx"}}, 100)
+	mustPutObjects(t, storage, "forms", []Object{{Id: "a", Payload: "x"}}, 110)
+	if _, err := storage.CreateBatch("tabs", []Object{{Id: "b", Payload: "x"}}, 110, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := storage.DeleteStorage(120, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	infos, err := storage.GetCollectionsInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("GetCollectionsInfo() after delete = %v", infos)
+	}
+	counts, err := storage.GetCollectionCounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 0 {
+		t.Errorf("GetCollectionCounts() after delete = %v", counts)
+	}
+	expectObjectNotFound(t, storage, "tabs", "a")
+	expectStorageLastModified(t, storage, 120)
+	expectUsage(t, storage, 0)
+
+	// Deleting an empty storage still moves its last modified time
+	if err := storage.DeleteStorage(100, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectStorageLastModified(t, storage, 120.01)
+}
@@ -11,7 +11,7 @@ URL = "https://sync.sateh.com"
 AUDIENCE = URL
 
 def get_info_collections(token):
-    url = URL + "/storage/1.5/2/info/collections"
+    url = URL + "/storage/1.5/%d/info/collections" % token["uid"]
     hawk_credentials = {"id": str(token["id"]), "key": str(token["key"]), "algorithm":"sha256"}
     #print "HAWK_CREDENTIALS", hawk_credentials
     hawk_header = hawk.client.header(url, "GET", {"credentials": hawk_credentials, "ext":""})
@@ -21,7 +21,7 @@ def get_info_collections(token):
     return r.json()
 
 def get_object(token, collection_name, object_id):
-    url = URL + "/storage/1.5/2/storage/%s/%s" % (collection_name, object_id)
+    url = URL + "/storage/1.5/%d/storage/%s/%s" % (token["uid"], collection_name, object_id)
     hawk_credentials = {"id": str(token["id"]), "key": str(token["key"]), "algorithm":"sha256"}
     #print "HAWK_CREDENTIALS", hawk_credentials
     hawk_header = hawk.client.header(url, "GET", {"credentials": hawk_credentials, "ext":""})
@@ -31,7 +31,7 @@ def get_object(token, collection_name, object_id):
     return r.json()
 
 def put_object(token, collection_name, o):
-    url = URL + "/storage/1.5/2/storage/%s/%s" % (collection_name, o["id"])
+    url = URL + "/storage/1.5/%d/storage/%s/%s" % (token["uid"], collection_name, o["id"])
     hawk_credentials = {"id": str(token["id"]), "key": str(token["key"]), "algorithm":"sha256"}
     #print "HAWK_CREDENTIALS", hawk_credentials
     hawk_header = hawk.client.header(url, "PUT", {"credentials": hawk_credentials, "ext":""})
@@ -41,7 +41,7 @@ def put_object(token, collection_name, o):
     return r.json()
 
 def get_objects(token, collection_name, newer, limit):
-    url = URL + "/storage/1.5/2/storage/%s?full=1&newer=%.2f&limit=%d" % (collection_name, newer, limit)
+    url = URL + "/storage/1.5/%d/storage/%s?full=1&newer=%.2f&limit=%d" % (token["uid"], collection_name, newer, limit)
     hawk_credentials = {"id": str(token["id"]), "key": str(token["key"]), "algorithm":"sha256"}
     #print "HAWK_CREDENTIALS", hawk_credentials
     hawk_header = hawk.client.header(url, "GET", {"credentials": hawk_credentials, "ext":""})
@@ -52,7 +52,7 @@ def get_objects(token, collection_name, newer, limit):
     #return r.json()
 
 def delete_collection_objects(token, collection_name):
-    url = URL + "/storage/1.5/2/storage/%s" % collection_name
+    url = URL + "/storage/1.5/%d/storage/%s" % (token["uid"], collection_name)
     hawk_credentials = {"id": str(token["id"]), "key": str(token["key"]), "algorithm":"sha256"}
     #print "HAWK_CREDENTIALS", hawk_credentials
     hawk_header = hawk.client.header(url, "DELETE", {"credentials": hawk_credentials, "ext":""})
@@ -62,7 +62,7 @@ def delete_collection_objects(token, collection_name):
     return r.json()
 
 def post_collection_objects(token, collection_name, objects):
-    url = URL + "/storage/1.5/2/storage/%s" % collection_name
+    url = URL + "/storage/1.5/%d/storage/%s" % (token["uid"], collection_name)
     hawk_credentials = {"id": str(token["id"]), "key": str(token["key"]), "algorithm":"sha256"}
     hawk_header = hawk.client.header(url, "POST", {"credentials": hawk_credentials, "ext":""})
     r = requests.post(url, headers={"Authorization":hawk_header["field"]}, data=json.dumps(objects))